@@ -0,0 +1,212 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"menie.org/mqtt2sql/handlers"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The configuration file is a JSON object whose keys are the option
+// names, the options given on the command line take precedence:
+//
+//	{"s": ["domos/dbdata", "spBv1.0/#"], "log-level": "debug", "interval": "5m"}
+//
+// Only the reloadable options are applied again on SIGHUP or through
+// the admin endpoint.
+var (
+	reloadable = []string{"s", "debug", "log-level", "interval", "grace", "consolidation-timeout", "late-tolerance", "m", "rules", "rules-apply", "delete-chunk", "delete-pause", "delete-after-commit", "partition", "partition-ahead"}
+	cmdline    = map[string]bool{}
+	reloadMu   sync.Mutex
+	// the options the pipeline runs with, a reload applies the ones that
+	// differ
+	applied map[string]string
+)
+
+// loadConfig applies the configuration file to the options not given
+// on the command line
+func loadConfig(filename string) error {
+	buff, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var values map[string]any
+	if err := json.Unmarshal(buff, &values); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for name, value := range values {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %q", filename, name)
+		}
+		if cmdline[name] {
+			continue
+		}
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			s = strconv.FormatBool(v)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			s = strings.Join(items, ",")
+		default:
+			return fmt.Errorf("%s: bad value for option %q", filename, name)
+		}
+		if err := flag.Set(name, s); err != nil {
+			return fmt.Errorf("%s: option %q: %w", filename, name, err)
+		}
+	}
+	return nil
+}
+
+// optionValues returns the value of every option
+func optionValues() map[string]string {
+	values := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) { values[f.Name] = f.Value.String() })
+	return values
+}
+
+// restoreOptions sets the options back to the values
+func restoreOptions(values map[string]string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != values[f.Name] {
+			f.Value.Set(values[f.Name])
+		}
+	})
+}
+
+// checkOptions validates the options applied to the consolidation
+func checkOptions() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(loglevel)); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	if grace < 0 || itemtime < 0 || lateness < 0 {
+		return fmt.Errorf("grace, consolidation-timeout and late-tolerance must not be negative")
+	}
+	if err := handlers.CheckDeletePolicy(delchunk, delpause); err != nil {
+		return err
+	}
+	return handlers.CheckPartitioning(partunit, partahead)
+}
+
+// setOptions applies the options checked by checkOptions to the
+// consolidation, except the interval which is applied by reload
+func setOptions() error {
+	return errors.Join(
+		handlers.SetConsolidationGrace(grace),
+		handlers.SetConsolidationTimeout(itemtime),
+		handlers.SetLateTolerance(lateness),
+		handlers.SetDeletePolicy(delchunk, delpause, deldefer),
+		handlers.SetPartitioning(partunit, partahead),
+	)
+}
+
+// checkReload reads the configuration file again and checks the options,
+// the mapping and the rules before anything is applied
+func checkReload() error {
+	if cfgfile != "" {
+		if err := loadConfig(cfgfile); err != nil {
+			return err
+		}
+	}
+	if err := checkOptions(); err != nil {
+		return err
+	}
+	if mapfile != "" {
+		if err := handlers.CheckMapping(mapfile); err != nil {
+			return fmt.Errorf("%s: %w", mapfile, err)
+		}
+	}
+	if rulesfile != "" && !handlers.CheckRuleFile(rulesfile) {
+		return fmt.Errorf("%s: invalid rules", rulesfile)
+	}
+	return nil
+}
+
+// reload reads the configuration file again and applies the reloadable
+// options to the running pipeline. Nothing is applied when an option is
+// invalid, the options are then left as they were
+func reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	slog.Info("Reloading", "config", cfgfile)
+	before := optionValues()
+	if err := checkReload(); err != nil {
+		restoreOptions(before)
+		slog.Error("Reload", "config", cfgfile, "error", err)
+		return err
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() != before[f.Name] && !slices.Contains(reloadable, f.Name) {
+			slog.Warn("Option changed, restart needed", "option", f.Name, "value", f.Value.String())
+		}
+	})
+
+	if mapfile != "" {
+		if err := handlers.LoadMapping(mapfile); err != nil {
+			restoreOptions(before)
+			slog.Error("Mapping", "filename", mapfile, "error", err)
+			return err
+		}
+	}
+	// checked, these can't fail
+	if err := errors.Join(setLogLevel(), setOptions()); err != nil {
+		slog.Error("Reload", "error", err)
+	}
+	if subtopic != applied["s"] {
+		handlers.Resubscribe(subtopic)
+	}
+	if interval.String() != applied["interval"] {
+		if err := handlers.SetConsolidationInterval(interval); err != nil {
+			slog.Error("Reload", "error", err)
+		}
+	}
+	applied = optionValues()
+
+	// the database is left as it was when the rules are not reconciled,
+	// the next reload tries again
+	if rulesfile != "" && !handlers.ReconcileRules(rulesfile, rulesmode) {
+		err := fmt.Errorf("%s: rules not reconciled", rulesfile)
+		slog.Error("Reload", "error", err)
+		return err
+	}
+
+	slog.Info("Reloaded", "config", cfgfile)
+	return nil
+}
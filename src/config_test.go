@@ -0,0 +1,122 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// keepOptions restores the options and the configuration file when the
+// test ends
+func keepOptions(t *testing.T) {
+	values, file, cmd, last := optionValues(), cfgfile, cmdline, applied
+	t.Cleanup(func() {
+		restoreOptions(values)
+		cfgfile, cmdline, applied = file, cmd, last
+	})
+}
+
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	keepOptions(t)
+	dir := t.TempDir()
+
+	tests := []struct {
+		content string
+		want    map[string]string
+		err     bool
+	}{
+		{`{"s": ["a/b", "spBv1.0/#"], "log-level": "warn", "interval": "5m", "partition-ahead": 2, "delete-after-commit": true}`, map[string]string{
+			"s": "a/b,spBv1.0/#", "log-level": "warn", "interval": "5m0s", "partition-ahead": "2", "delete-after-commit": "true",
+		}, false},
+		// the command line takes precedence
+		{`{"h": "tcp://other:1883"}`, map[string]string{"h": "tcp://mqtt:1883"}, false},
+		{`{"nosuch": 1}`, nil, true},
+		{`{"interval": "soon"}`, nil, true},
+		{`{"interval": {"minutes": 5}}`, nil, true},
+		{`{"interval": `, nil, true},
+	}
+	for i, tt := range tests {
+		cmdline = map[string]bool{"h": true}
+		err := loadConfig(writeFile(t, dir, "config.json", tt.content))
+		if (err != nil) != tt.err {
+			t.Errorf("%d: loadConfig error %v, want error %v", i, err, tt.err)
+			continue
+		}
+		values := optionValues()
+		for name, want := range tt.want {
+			if values[name] != want {
+				t.Errorf("%d: option %s = %q, want %q", i, name, values[name], want)
+			}
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	keepOptions(t)
+	dir := t.TempDir()
+	broken := writeFile(t, dir, "broken.json", `{"rules": [{"topic": "c", "values": []}]}`)
+	cfgfile = filepath.Join(dir, "config.json")
+	cmdline = map[string]bool{}
+	for name, value := range map[string]string{"interval": "1m", "s": "a", "delete-chunk": "10000", "partition": "", "m": ""} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applied = optionValues()
+
+	tests := []struct {
+		name     string
+		content  string
+		err      bool
+		interval time.Duration
+		subtopic string
+	}{
+		{"applied", `{"interval": "5m", "s": "a,b"}`, false, 5 * time.Minute, "a,b"},
+		{"bad delete chunk", `{"interval": "10m", "s": "c", "delete-chunk": "-1"}`, true, 5 * time.Minute, "a,b"},
+		{"bad partition", `{"interval": "10m", "s": "c", "partition": "week"}`, true, 5 * time.Minute, "a,b"},
+		{"bad interval", `{"interval": "0s", "s": "c"}`, true, 5 * time.Minute, "a,b"},
+		{"bad mapping", `{"interval": "10m", "s": "c", "m": "` + broken + `"}`, true, 5 * time.Minute, "a,b"},
+		// nothing was applied by the failed reloads, all of it is now
+		{"applied again", `{"interval": "10m", "s": "c"}`, false, 10 * time.Minute, "c"},
+	}
+	for _, tt := range tests {
+		writeFile(t, dir, "config.json", tt.content)
+		if err := reload(); (err != nil) != tt.err {
+			t.Errorf("%s: reload error %v, want error %v", tt.name, err, tt.err)
+		}
+		if interval != tt.interval || subtopic != tt.subtopic || mapfile != "" {
+			t.Errorf("%s: options %s %q %q, want %s %q none", tt.name, interval, subtopic, mapfile, tt.interval, tt.subtopic)
+		}
+		if applied["interval"] != tt.interval.String() || applied["s"] != tt.subtopic {
+			t.Errorf("%s: applied %s %q, want %s %q", tt.name, applied["interval"], applied["s"], tt.interval, tt.subtopic)
+		}
+	}
+}
@@ -5,6 +5,9 @@ go 1.24.3
 require (
 	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/go-sql-driver/mysql v1.9.2
+	github.com/klauspost/compress v1.18.0
+	google.golang.org/protobuf v1.36.9
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
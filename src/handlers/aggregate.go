@@ -0,0 +1,533 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Aggregate is a column of a consolidated table: the function applied
+// to a field of the source table. The field defaults to the value of a
+// measurement table, or to the column produced by the same function in
+// a consolidated table, the column name defaults to v<func>
+type Aggregate struct {
+	Func   string `yaml:"func"`
+	Field  string `yaml:"field,omitempty"`
+	Column string `yaml:"column,omitempty"`
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func (a Aggregate) column() string {
+	if a.Column != "" {
+		return a.Column
+	}
+	return "v" + a.Func
+}
+
+func (item *Item) aggrString() string {
+	var s []string
+	for _, a := range item.aggr {
+		s = append(s, fmt.Sprintf("%s(%s) AS %s", a.Func, a.Field, a.column()))
+	}
+	return strings.Join(s, ", ")
+}
+
+// An aggregate function is run by the database when it has a SQL
+// template, %[1]s being the column, otherwise the source rows are read
+// and the function is computed here, ws being the count of source rows
+// of each row. On a consolidated source, the column produced by the same
+// function is merged: the counts and the integrals are summed up, the
+// averages weighted by the counts. The functions needing the source rows
+// are refused. The hidden columns of a function, named after its column,
+// keep what its upsert needs to merge the rows, the functions without
+// upsert can't be merged. The functions carrying the last point of the
+// previous bucket, the integrals, get it first in ts and vs
+type aggregate struct {
+	sql    string
+	merge  string
+	upsert string
+	hidden []hiddenColumn
+	whole  bool
+	carry  bool
+	calc   func(ts []float64, vs []float64, ws []float64) float64
+}
+
+type hiddenColumn struct {
+	suffix string
+	fn     string
+}
+
+// upsert merges a column of a new row into the existing one, the count
+// and the hidden columns being updated after the visible ones
+const (
+	upsertAdd    = "%[1]s = %[1]s + VALUES(%[1]s)"
+	upsertMin    = "%[1]s = LEAST(%[1]s, VALUES(%[1]s))"
+	upsertMax    = "%[1]s = GREATEST(%[1]s, VALUES(%[1]s))"
+	upsertKeep   = "%[1]s = %[1]s"
+	upsertAvg    = "%[1]s = (%[1]s * n + VALUES(%[1]s) * VALUES(n)) / (n + VALUES(n))"
+	upsertFirst  = "%[1]s = IF(VALUES(%[1]s_ts) < %[1]s_ts, VALUES(%[1]s), %[1]s)"
+	upsertLast   = "%[1]s = IF(VALUES(%[1]s_ts) >= %[1]s_ts, VALUES(%[1]s), %[1]s)"
+	upsertStddev = "%[1]s = SQRT(GREATEST((%[1]s_sq + VALUES(%[1]s_sq)) / (n + VALUES(n)) - POW((%[1]s_sum + VALUES(%[1]s_sum)) / (n + VALUES(n)), 2), 0))"
+)
+
+// countCol is the hidden column of the consolidated tables counting the
+// source rows of each row, it weights the averages when rows are merged
+const countCol = "n"
+
+var aggregates = map[string]aggregate{
+	"sum":       {sql: "SUM(%[1]s)", upsert: upsertAdd, calc: calcSum},
+	"min":       {sql: "MIN(%[1]s)", upsert: upsertMin, calc: calcMin},
+	"max":       {sql: "MAX(%[1]s)", upsert: upsertMax, calc: calcMax},
+	"avg":       {sql: "AVG(%[1]s)", merge: "wavg", upsert: upsertAvg, calc: calcAvg},
+	"count":     {sql: "COUNT(%[1]s)", merge: "sum", upsert: upsertAdd, calc: calcCount},
+	"stddev":    {sql: "STDDEV_POP(%[1]s)", upsert: upsertStddev, hidden: []hiddenColumn{{"_sum", "sum"}, {"_sq", "sumsq"}}, whole: true, calc: calcStddev},
+	"first":     {upsert: upsertFirst, hidden: []hiddenColumn{{"_ts", "firstts"}}, calc: calcFirst},
+	"last":      {upsert: upsertLast, hidden: []hiddenColumn{{"_ts", "lastts"}}, calc: calcLast},
+	"median":    {whole: true, calc: calcPercentile(50)},
+	"integral":  {merge: "sum", carry: true, calc: calcIntegral(1)},
+	"integralh": {merge: "sum", carry: true, calc: calcIntegral(3600)},
+}
+
+// internalAggregates compute the hidden columns
+var internalAggregates = map[string]aggregate{
+	"sumsq":   {sql: "SUM(%[1]s * %[1]s)", upsert: upsertAdd, calc: calcSumSq},
+	"wavg":    {sql: "SUM(%[1]s * n) / SUM(n)", upsert: upsertAvg, calc: calcWeightedAvg},
+	"firstts": {upsert: upsertMin, calc: calcFirstTs},
+	"lastts":  {upsert: upsertMax, calc: calcLastTs},
+}
+
+// lookupAggregate also accepts the percentiles p1 to p99
+func lookupAggregate(name string) (aggregate, bool) {
+	if a, ok := aggregates[name]; ok {
+		return a, true
+	}
+	if p, ok := strings.CutPrefix(name, "p"); ok {
+		if n, err := strconv.Atoi(p); err == nil && n > 0 && n < 100 && strconv.Itoa(n) == p {
+			return aggregate{whole: true, calc: calcPercentile(float64(n))}, true
+		}
+	}
+	return aggregate{}, false
+}
+
+// aggregateFunc returns the function of a column of a prepared item
+func aggregateFunc(name string) aggregate {
+	if a, ok := internalAggregates[name]; ok {
+		return a
+	}
+	a, _ := lookupAggregate(name)
+	return a
+}
+
+// prepare checks the aggregate functions of the item and computes its
+// column lists, src is the item producing the source table, if any. The
+// hidden columns follow the visible ones. The first and last values of
+// a consolidated source are ordered by their own ts column
+func (item *Item) prepare(src *Item) error {
+	item.names, item.funcs, item.cols, item.tscols = nil, nil, nil, nil
+	item.tiered = src != nil
+	var hidden []hiddenColumn
+	var hiddenOf []int
+	for _, ag := range item.aggr {
+		f := ag.Func
+		a, ok := lookupAggregate(f)
+		if !ok {
+			return fmt.Errorf("unknown aggregate function %q", ag.Func)
+		}
+		name := ag.column()
+		if !identifier.MatchString(name) {
+			return fmt.Errorf("bad column name %q", name)
+		}
+		col, fn, tscol := ag.Field, f, "ts"
+		if src == nil {
+			if col == "" {
+				col = defaultCol
+			}
+		} else {
+			if col == "" {
+				col = "v" + f
+			}
+			idx := slices.IndexFunc(src.aggr, func(s Aggregate) bool { return s.column() == col })
+			if idx < 0 {
+				return fmt.Errorf("no column %q in %s", col, src.dst)
+			}
+			if a.whole {
+				return fmt.Errorf("%s needs the source rows, %s is consolidated", f, src.dst)
+			}
+			if src.aggr[idx].Func == f && a.merge != "" {
+				fn = a.merge
+				a = aggregateFunc(fn)
+			}
+			if src.aggr[idx].Func == f && len(a.hidden) > 0 && a.hidden[0].suffix == "_ts" {
+				tscol = col + "_ts"
+			}
+		}
+		if !identifier.MatchString(col) {
+			return fmt.Errorf("bad field name %q", col)
+		}
+		item.names = append(item.names, name)
+		item.funcs = append(item.funcs, fn)
+		item.cols = append(item.cols, col)
+		item.tscols = append(item.tscols, tscol)
+		for _, h := range a.hidden {
+			hidden = append(hidden, h)
+			hiddenOf = append(hiddenOf, len(item.names)-1)
+		}
+	}
+	for i, h := range hidden {
+		parent := hiddenOf[i]
+		item.names = append(item.names, item.names[parent]+h.suffix)
+		item.funcs = append(item.funcs, h.fn)
+		item.cols = append(item.cols, item.cols[parent])
+		item.tscols = append(item.tscols, item.tscols[parent])
+	}
+	for i, name := range item.names {
+		if strings.EqualFold(name, countCol) || slices.ContainsFunc(item.names[:i], func(n string) bool { return strings.EqualFold(n, name) }) {
+			return fmt.Errorf("reserved or duplicate column name %q", name)
+		}
+	}
+
+	var exprs []string
+	inSQL := true
+	for i, fn := range item.funcs {
+		a := aggregateFunc(fn)
+		exprs = append(exprs, fmt.Sprintf(a.sql, item.cols[i]))
+		inSQL = inSQL && a.sql != ""
+	}
+	item.clist = strings.Join(item.names, ", ")
+	item.dlist = strings.Join(item.names, " DOUBLE NOT NULL, ")
+	if item.dlist != "" {
+		item.dlist += " DOUBLE NOT NULL"
+	}
+	// empty when a function has to be computed here
+	item.alist = ""
+	if inSQL {
+		item.alist = strings.Join(exprs, ", ")
+	}
+	return nil
+}
+
+// hiddenNames returns the hidden columns of the item
+func (item *Item) hiddenNames() []string {
+	return item.names[len(item.aggr):]
+}
+
+// mergeable tells whether the consolidated rows of the item can be
+// merged with the rows of late datapoints
+func (item *Item) mergeable() bool {
+	for _, fn := range item.funcs {
+		if aggregateFunc(fn).upsert == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// carries tells whether a function of the item needs the last point of
+// the previous bucket
+func (item *Item) carries() bool {
+	return slices.ContainsFunc(item.funcs, func(fn string) bool { return aggregateFunc(fn).carry })
+}
+
+// countExpr counts the source rows of a consolidated row
+func (item *Item) countExpr() string {
+	if item.tiered {
+		return "SUM(" + countCol + ")"
+	}
+	return "COUNT(*)"
+}
+
+// onDuplicate is the clause merging the rows into the existing ones,
+// the functions without upsert keep the existing value. The count is
+// updated last, as the averages use the previous one
+func (item *Item) onDuplicate() string {
+	var set []string
+	for i, fn := range item.funcs {
+		a := aggregateFunc(fn)
+		if a.upsert == "" {
+			a.upsert = upsertKeep
+		}
+		set = append(set, fmt.Sprintf(a.upsert, item.names[i]))
+	}
+	set = append(set, fmt.Sprintf(upsertAdd, countCol))
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+}
+
+// InsertComputedData consolidates [t1, t2) computing the aggregates
+// from the source rows, sorted by sensor and time. The carrying functions
+// also read the bucket before t1, whose last point starts the first
+// interval of the next bucket of the same sensor
+func (db *DB) InsertComputedData(item Item, t1 int64, t2 int64) bool {
+	_, ok := db.insertComputedData(item, t1, t2)
+	return ok
+}
+
+func (db *DB) insertComputedData(item Item, t1 int64, t2 int64) (int64, bool) {
+	selectTemplate := `
+	SELECT ts, %s, %s, %s, %s FROM %s
+	WHERE ts >= %d AND ts < %d%s
+	ORDER BY %s, ts;
+	`
+	insertTemplate := `
+	INSERT INTO %s (ts, %s, %s, %s) values (?, %s, %s, ?)%s;
+	`
+	placeholders := func(n int) string {
+		return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+	}
+	sensorCols := sensorColumns()
+	sensor := strings.Join(sensorCols, ", ")
+
+	cmd := fmt.Sprintf(insertTemplate, item.dst, sensor, item.clist, countCol, placeholders(len(sensorCols)), placeholders(len(item.names)), item.onDuplicate())
+	stmt, err := db.Prepare(cmd)
+	if err != nil {
+		slog.Warn("Unable to prepare stmt", "table", item.dst, "cmd", cmd, "err", err)
+		if db.CreateConsolidatedTable(item) && db.CreateConsolidatedIndex(item.dst) && db.migrateConsolidatedTables(item) {
+			if stmt, err = db.Prepare(cmd); err != nil {
+				slog.Error("Unable to prepare stmt", "table", item.dst, "cmd", cmd, "err", err)
+				return 0, false
+			}
+		} else {
+			return 0, false
+		}
+	}
+	defer stmt.Close()
+
+	// the source rows count for one, or for their count when consolidated
+	weight := "1"
+	if item.tiered {
+		weight = countCol
+	}
+	from := t1
+	if item.carries() && t1 > 0 {
+		from = item.bucket.floor(t1 - 1)
+	}
+	filter, args := item.filter.where()
+	query := fmt.Sprintf(selectTemplate, sensor, weight, strings.Join(item.cols, ", "), strings.Join(item.tscols, ", "), item.src, from, t2, filter, sensor)
+	slog.Debug("Consolidation", "cmd", query, "args", args)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		slog.Error("Unable to query", "table", item.src, "cmd", query, "err", err)
+		return 0, false
+	}
+
+	// the sensor is identified by its key, or by its id, name and place
+	type group struct {
+		ts     int64
+		sensor [3]sql.NullString
+	}
+	var (
+		results [][]any
+		current group
+		count   int64
+		ws      []float64
+		ts      = make([][]float64, len(item.cols))
+		vs      = make([][]float64, len(item.cols))
+	)
+	flush := func() {
+		if len(ws) == 0 {
+			return
+		}
+		row := []any{current.ts}
+		for _, s := range current.sensor[:len(sensorCols)] {
+			row = append(row, s)
+		}
+		for i, fn := range item.funcs {
+			row = append(row, aggregateFunc(fn).calc(ts[i], vs[i], ws))
+			ts[i], vs[i] = ts[i][:0], vs[i][:0]
+		}
+		results = append(results, append(row, count))
+		ws = ws[:0]
+		count = 0
+	}
+
+	values := make([]float64, len(item.cols))
+	times := make([]float64, len(item.cols))
+	// the previous row, carried into the next bucket
+	var previous group
+	prevValues := make([]float64, len(item.cols))
+	prevTimes := make([]float64, len(item.cols))
+	dest := make([]any, 2+len(sensorCols)+2*len(item.cols))
+	for rows.Next() {
+		var t float64
+		var n int64
+		var g group
+		dest[0] = &t
+		for i := range sensorCols {
+			dest[1+i] = &g.sensor[i]
+		}
+		dest[1+len(sensorCols)] = &n
+		for i := range values {
+			dest[2+len(sensorCols)+i] = &values[i]
+			dest[2+len(sensorCols)+len(values)+i] = &times[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			slog.Error("Unable to fetch", "table", item.src, "err", err)
+			rows.Close()
+			return 0, false
+		}
+		g.ts = item.bucket.floor(int64(math.Floor(t)))
+		if g.ts < t1 {
+			previous = g
+			copy(prevValues, values)
+			copy(prevTimes, times)
+			continue
+		}
+		if g != current {
+			flush()
+			current = g
+			if previous.sensor == g.sensor && previous.ts == item.bucket.floor(g.ts-1) {
+				for i, fn := range item.funcs {
+					if aggregateFunc(fn).carry {
+						ts[i] = append(ts[i], prevTimes[i])
+						vs[i] = append(vs[i], prevValues[i])
+					}
+				}
+			}
+		}
+		ws = append(ws, float64(n))
+		count += n
+		for i, v := range values {
+			ts[i] = append(ts[i], times[i])
+			vs[i] = append(vs[i], v)
+		}
+		previous = g
+		copy(prevValues, values)
+		copy(prevTimes, times)
+	}
+	flush()
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		slog.Error("Unable to fetch", "table", item.src, "err", err)
+		return 0, false
+	}
+
+	// the rows are read, the connection is free for the inserts
+	for _, row := range results {
+		if _, err := stmt.ExecContext(db.execContext(), row...); err != nil {
+			slog.Error("Insert error", "table", item.dst, "data", row, "err", err)
+			return 0, false
+		}
+	}
+
+	slog.Info("Inserted", "table", item.dst, "t1", t1, "t2", t2, "affected rows", len(results))
+	return int64(len(results)), true
+}
+
+func calcSum(ts []float64, vs []float64, ws []float64) float64 {
+	s := 0.0
+	for _, v := range vs {
+		s += v
+	}
+	return s
+}
+
+func calcMin(ts []float64, vs []float64, ws []float64) float64 {
+	return slices.Min(vs)
+}
+
+func calcMax(ts []float64, vs []float64, ws []float64) float64 {
+	return slices.Max(vs)
+}
+
+func calcAvg(ts []float64, vs []float64, ws []float64) float64 {
+	return calcSum(ts, vs, ws) / float64(len(vs))
+}
+
+// calcWeightedAvg averages averages of ws rows
+func calcWeightedAvg(ts []float64, vs []float64, ws []float64) float64 {
+	s, n := 0.0, 0.0
+	for i, v := range vs {
+		s += v * ws[i]
+		n += ws[i]
+	}
+	return s / n
+}
+
+func calcCount(ts []float64, vs []float64, ws []float64) float64 {
+	return float64(len(vs))
+}
+
+// calcStddev is the population standard deviation, as STDDEV_POP
+func calcStddev(ts []float64, vs []float64, ws []float64) float64 {
+	m := calcAvg(ts, vs, ws)
+	s := 0.0
+	for _, v := range vs {
+		s += (v - m) * (v - m)
+	}
+	return math.Sqrt(s / float64(len(vs)))
+}
+
+func calcSumSq(ts []float64, vs []float64, ws []float64) float64 {
+	s := 0.0
+	for _, v := range vs {
+		s += v * v
+	}
+	return s
+}
+
+// the values are sorted by time
+func calcFirst(ts []float64, vs []float64, ws []float64) float64 {
+	return vs[0]
+}
+
+func calcLast(ts []float64, vs []float64, ws []float64) float64 {
+	return vs[len(vs)-1]
+}
+
+func calcFirstTs(ts []float64, vs []float64, ws []float64) float64 {
+	return ts[0]
+}
+
+func calcLastTs(ts []float64, vs []float64, ws []float64) float64 {
+	return ts[len(ts)-1]
+}
+
+// calcPercentile interpolates between the closest ranks
+func calcPercentile(p float64) func([]float64, []float64, []float64) float64 {
+	return func(ts []float64, vs []float64, ws []float64) float64 {
+		sorted := slices.Clone(vs)
+		slices.Sort(sorted)
+		r := p / 100 * float64(len(sorted)-1)
+		i := int(r)
+		if i+1 >= len(sorted) {
+			return sorted[i]
+		}
+		return sorted[i] + (r-float64(i))*(sorted[i+1]-sorted[i])
+	}
+}
+
+// calcIntegral integrates the values over time with the trapezoidal
+// rule, unit is in seconds: 3600 gives Wh from W. The interval from the
+// carried point of the previous bucket belongs to the bucket ending it
+func calcIntegral(unit float64) func([]float64, []float64, []float64) float64 {
+	return func(ts []float64, vs []float64, ws []float64) float64 {
+		s := 0.0
+		for i := 1; i < len(vs); i++ {
+			s += (vs[i] + vs[i-1]) / 2 * (ts[i] - ts[i-1])
+		}
+		return s / unit
+	}
+}
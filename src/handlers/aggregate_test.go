@@ -0,0 +1,148 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestAggregateCalc(t *testing.T) {
+	ts := []float64{0, 10, 20, 40}
+	vs := []float64{4, 2, 6, 8}
+	ws := []float64{1, 1, 1, 1}
+	tests := []struct {
+		fn   string
+		ts   []float64
+		vs   []float64
+		ws   []float64
+		want float64
+	}{
+		{"sum", ts, vs, ws, 20},
+		{"min", ts, vs, ws, 2},
+		{"max", ts, vs, ws, 8},
+		{"avg", ts, vs, ws, 5},
+		{"count", ts, vs, ws, 4},
+		{"stddev", ts, vs, ws, math.Sqrt(5)},
+		{"sumsq", ts, vs, ws, 120},
+		{"first", ts, vs, ws, 4},
+		{"last", ts, vs, ws, 8},
+		{"firstts", ts, vs, ws, 0},
+		{"lastts", ts, vs, ws, 40},
+		{"median", ts, vs, ws, 5},
+		{"p25", ts, vs, ws, 3.5},
+		{"p99", ts, vs, ws, 7.94},
+		{"wavg", nil, []float64{2, 5}, []float64{3, 1}, 2.75},
+		// (4+2)/2*10 + (2+6)/2*10 + (6+8)/2*20
+		{"integral", ts, vs, ws, 210},
+		{"integralh", ts, vs, ws, 210.0 / 3600},
+		{"integral", []float64{5}, []float64{3}, ws[:1], 0},
+		// the point carried from the previous bucket starts the integral
+		{"integral", []float64{-30, 5}, []float64{2, 4}, ws[:1], 105},
+	}
+	for _, tt := range tests {
+		a := aggregateFunc(tt.fn)
+		if a.calc == nil {
+			t.Errorf("%s: no function", tt.fn)
+			continue
+		}
+		if got := a.calc(tt.ts, tt.vs, tt.ws); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s(%v, %v) = %v, want %v", tt.fn, tt.ts, tt.vs, got, tt.want)
+		}
+	}
+}
+
+func TestAggregateCarry(t *testing.T) {
+	tests := []struct {
+		aggr    []Aggregate
+		carries bool
+	}{
+		{[]Aggregate{{Func: "avg"}, {Func: "last"}}, false},
+		{[]Aggregate{{Func: "avg"}, {Func: "integralh"}}, true},
+		{[]Aggregate{{Func: "integral"}}, true},
+	}
+	for _, tt := range tests {
+		item := Item{dst: "dst", aggr: tt.aggr}
+		if err := item.prepare(nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := item.carries(); got != tt.carries {
+			t.Errorf("%v: carries() = %v, want %v", tt.aggr, got, tt.carries)
+		}
+	}
+
+	// the consolidated integrals are summed up, without carry
+	src := Item{dst: "src", aggr: []Aggregate{{Func: "integral"}}}
+	if err := src.prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	item := Item{dst: "dst", aggr: []Aggregate{{Func: "integral"}}}
+	if err := item.prepare(&src); err != nil {
+		t.Fatal(err)
+	}
+	if item.carries() {
+		t.Errorf("tiered integral carries")
+	}
+}
+
+func TestOnDuplicate(t *testing.T) {
+	tests := []struct {
+		aggr      []Aggregate
+		want      string
+		mergeable bool
+	}{
+		{
+			[]Aggregate{{Func: "sum"}, {Func: "avg"}, {Func: "min"}, {Func: "max"}},
+			" ON DUPLICATE KEY UPDATE vsum = vsum + VALUES(vsum), " +
+				"vavg = (vavg * n + VALUES(vavg) * VALUES(n)) / (n + VALUES(n)), " +
+				"vmin = LEAST(vmin, VALUES(vmin)), vmax = GREATEST(vmax, VALUES(vmax)), n = n + VALUES(n)",
+			true,
+		},
+		{
+			[]Aggregate{{Func: "first"}, {Func: "last", Column: "latest"}},
+			" ON DUPLICATE KEY UPDATE vfirst = IF(VALUES(vfirst_ts) < vfirst_ts, VALUES(vfirst), vfirst), " +
+				"latest = IF(VALUES(latest_ts) >= latest_ts, VALUES(latest), latest), " +
+				"vfirst_ts = LEAST(vfirst_ts, VALUES(vfirst_ts)), latest_ts = GREATEST(latest_ts, VALUES(latest_ts)), n = n + VALUES(n)",
+			true,
+		},
+		{
+			[]Aggregate{{Func: "stddev"}},
+			" ON DUPLICATE KEY UPDATE vstddev = SQRT(GREATEST((vstddev_sq + VALUES(vstddev_sq)) / (n + VALUES(n)) - " +
+				"POW((vstddev_sum + VALUES(vstddev_sum)) / (n + VALUES(n)), 2), 0)), " +
+				"vstddev_sum = vstddev_sum + VALUES(vstddev_sum), vstddev_sq = vstddev_sq + VALUES(vstddev_sq), n = n + VALUES(n)",
+			true,
+		},
+		{
+			[]Aggregate{{Func: "count"}, {Func: "median"}, {Func: "integral"}},
+			" ON DUPLICATE KEY UPDATE vcount = vcount + VALUES(vcount), vmedian = vmedian, vintegral = vintegral, n = n + VALUES(n)",
+			false,
+		},
+	}
+	for _, tt := range tests {
+		item := Item{dst: "dst", aggr: tt.aggr}
+		if err := item.prepare(nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := item.onDuplicate(); got != tt.want {
+			t.Errorf("%v: onDuplicate()\n got %s\nwant %s", tt.aggr, got, tt.want)
+		}
+		if got := item.mergeable(); got != tt.mergeable {
+			t.Errorf("%v: mergeable() = %v, want %v", tt.aggr, got, tt.mergeable)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"slices"
+	"time"
+	_ "time/tzdata"
+)
+
+// A bucketer splits the time, in seconds since the epoch, into the
+// periods of a dispatching item. Without unit the period is a number of
+// seconds, as FLOOR(ts/period)*period, with the day, week (from monday)
+// or month unit it is a number of calendar units in the time zone
+type bucketer interface {
+	floor(t int64) int64
+	next(t int64) int64
+	String() string
+}
+
+type secondsBucketer struct {
+	period int64
+}
+
+type calendarBucketer struct {
+	unit string
+	n    int
+	loc  *time.Location
+}
+
+func newBucketer(period int64, unit string, timezone string) (bucketer, error) {
+	if period <= 0 {
+		return nil, fmt.Errorf("bad period %d", period)
+	}
+	switch unit {
+	case "", "s", "second":
+		if timezone != "" {
+			return nil, fmt.Errorf("time zone %q without calendar unit", timezone)
+		}
+		return secondsBucketer{period}, nil
+	case "day", "week", "month":
+	default:
+		return nil, fmt.Errorf("unknown period unit %q", unit)
+	}
+	loc := time.Local
+	if timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(timezone); err != nil {
+			return nil, err
+		}
+	}
+	return calendarBucketer{unit: unit, n: int(period), loc: loc}, nil
+}
+
+func (b secondsBucketer) floor(t int64) int64 {
+	if t < 0 {
+		return (t - b.period + 1) / b.period * b.period
+	}
+	return t / b.period * b.period
+}
+
+func (b secondsBucketer) next(t int64) int64 {
+	return b.floor(t) + b.period
+}
+
+func (b secondsBucketer) String() string {
+	return fmt.Sprintf("%ds", b.period)
+}
+
+// the days and weeks are counted from thursday 1970-01-01 and monday
+// 1970-01-05, the months from 1970-01, so that n units are aligned
+func (b calendarBucketer) floor(t int64) int64 {
+	lt := time.Unix(t, 0).In(b.loc)
+	y, m, d := lt.Date()
+	switch b.unit {
+	case "day":
+		days := daysSinceEpoch(y, m, d)
+		days -= mod(days, b.n)
+		return time.Date(1970, 1, 1+days, 0, 0, 0, 0, b.loc).Unix()
+	case "week":
+		days := daysSinceEpoch(y, m, d) - 4
+		days -= mod(days, 7*b.n)
+		return time.Date(1970, 1, 5+days, 0, 0, 0, 0, b.loc).Unix()
+	default:
+		months := (y-1970)*12 + int(m) - 1
+		months -= mod(months, b.n)
+		return time.Date(1970, time.Month(1+months), 1, 0, 0, 0, 0, b.loc).Unix()
+	}
+}
+
+func (b calendarBucketer) next(t int64) int64 {
+	start := time.Unix(b.floor(t), 0).In(b.loc)
+	y, m, d := start.Date()
+	switch b.unit {
+	case "day":
+		return time.Date(y, m, d+b.n, 0, 0, 0, 0, b.loc).Unix()
+	case "week":
+		return time.Date(y, m, d+7*b.n, 0, 0, 0, 0, b.loc).Unix()
+	default:
+		return time.Date(y, m+time.Month(b.n), 1, 0, 0, 0, 0, b.loc).Unix()
+	}
+}
+
+func (b calendarBucketer) String() string {
+	return fmt.Sprintf("%d %s %s", b.n, b.unit, b.loc)
+}
+
+func daysSinceEpoch(y int, m time.Month, d int) int {
+	return int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+}
+
+func mod(a int, n int) int {
+	return (a%n + n) % n
+}
+
+// alignedOn tells whether each bucket of b is made of whole buckets of
+// src, so that b can be consolidated from src
+func alignedOn(b bucketer, src bucketer) bool {
+	switch s := src.(type) {
+	case secondsBucketer:
+		switch d := b.(type) {
+		case secondsBucketer:
+			return d.period%s.period == 0
+		case calendarBucketer:
+			// the local midnights fall on the buckets of the source, with
+			// every offset of the zone, standard and daylight saving
+			if 86400%s.period != 0 {
+				return false
+			}
+			now := time.Now()
+			for _, offset := range zoneOffsets(d.loc, now.AddDate(-zoneYears, 0, 0), now.AddDate(zoneYears, 0, 0)) {
+				if int64(offset)%s.period != 0 {
+					return false
+				}
+			}
+			return true
+		}
+	case calendarBucketer:
+		d, ok := b.(calendarBucketer)
+		if !ok || d.loc.String() != s.loc.String() {
+			return false
+		}
+		switch {
+		case s.unit == d.unit:
+			return d.n%s.n == 0
+		case s.unit == "day" && s.n == 1:
+			return true
+		}
+	}
+	return false
+}
+
+// zoneYears is the span, before and after now, of the offsets of a zone
+// checked by alignedOn
+const zoneYears = 10
+
+// zoneOffsets returns the offsets, in seconds, used by the zone between
+// from and to
+func zoneOffsets(loc *time.Location, from time.Time, to time.Time) []int {
+	var offsets []int
+	for t := from.In(loc); t.Before(to); {
+		_, offset := t.Zone()
+		if !slices.Contains(offsets, offset) {
+			offsets = append(offsets, offset)
+		}
+		_, end := t.ZoneBounds()
+		if end.IsZero() {
+			break
+		}
+		t = end.In(loc)
+	}
+	return offsets
+}
@@ -0,0 +1,198 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func mustBucketer(t *testing.T, period int64, unit string, timezone string) bucketer {
+	t.Helper()
+	b, err := newBucketer(period, unit, timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestNewBucketer(t *testing.T) {
+	tests := []struct {
+		period   int64
+		unit     string
+		timezone string
+		want     string
+		err      bool
+	}{
+		{300, "", "", "300s", false},
+		{60, "second", "", "60s", false},
+		{1, "day", "UTC", "1 day UTC", false},
+		{2, "week", "Europe/Paris", "2 week Europe/Paris", false},
+		{0, "", "", "", true},
+		{-60, "", "", "", true},
+		{60, "", "UTC", "", true},
+		{1, "year", "", "", true},
+		{1, "day", "Nowhere/Else", "", true},
+	}
+	for _, tt := range tests {
+		b, err := newBucketer(tt.period, tt.unit, tt.timezone)
+		if (err != nil) != tt.err {
+			t.Errorf("newBucketer(%d, %q, %q) error %v, want error %v", tt.period, tt.unit, tt.timezone, err, tt.err)
+			continue
+		}
+		if err == nil && b.String() != tt.want {
+			t.Errorf("newBucketer(%d, %q, %q) = %s, want %s", tt.period, tt.unit, tt.timezone, b, tt.want)
+		}
+	}
+}
+
+func TestBucketFloorNext(t *testing.T) {
+	paris := mustLoad(t, "Europe/Paris")
+	tests := []struct {
+		name      string
+		b         bucketer
+		t         int64
+		floor     int64
+		next      int64
+		nextAfter time.Duration
+	}{
+		{"seconds", mustBucketer(t, 300, "", ""), 1000, 900, 1200, 0},
+		{"seconds on boundary", mustBucketer(t, 300, "", ""), 1200, 1200, 1500, 0},
+		{"seconds negative", mustBucketer(t, 300, "", ""), -1, -300, 0, 0},
+		{
+			"day spring forward", mustBucketer(t, 1, "day", "Europe/Paris"),
+			time.Date(2025, 3, 30, 12, 0, 0, 0, paris).Unix(),
+			time.Date(2025, 3, 30, 0, 0, 0, 0, paris).Unix(),
+			time.Date(2025, 3, 31, 0, 0, 0, 0, paris).Unix(),
+			23 * time.Hour,
+		},
+		{
+			"day fall back", mustBucketer(t, 1, "day", "Europe/Paris"),
+			time.Date(2025, 10, 26, 23, 59, 59, 0, paris).Unix(),
+			time.Date(2025, 10, 26, 0, 0, 0, 0, paris).Unix(),
+			time.Date(2025, 10, 27, 0, 0, 0, 0, paris).Unix(),
+			25 * time.Hour,
+		},
+		{
+			"two days", mustBucketer(t, 2, "day", "UTC"),
+			time.Date(2025, 10, 18, 6, 0, 0, 0, time.UTC).Unix(),
+			time.Date(2025, 10, 17, 0, 0, 0, 0, time.UTC).Unix(),
+			time.Date(2025, 10, 19, 0, 0, 0, 0, time.UTC).Unix(),
+			48 * time.Hour,
+		},
+		{
+			"week from monday", mustBucketer(t, 1, "week", "UTC"),
+			time.Date(2025, 10, 18, 6, 0, 0, 0, time.UTC).Unix(),
+			time.Date(2025, 10, 13, 0, 0, 0, 0, time.UTC).Unix(),
+			time.Date(2025, 10, 20, 0, 0, 0, 0, time.UTC).Unix(),
+			7 * 24 * time.Hour,
+		},
+		{
+			"quarter", mustBucketer(t, 3, "month", "UTC"),
+			time.Date(2025, 5, 15, 0, 0, 0, 0, time.UTC).Unix(),
+			time.Date(2025, 4, 1, 0, 0, 0, 0, time.UTC).Unix(),
+			time.Date(2025, 7, 1, 0, 0, 0, 0, time.UTC).Unix(),
+			91 * 24 * time.Hour,
+		},
+		{
+			"month across dst", mustBucketer(t, 1, "month", "Europe/Paris"),
+			time.Date(2025, 3, 1, 0, 0, 0, 0, paris).Unix(),
+			time.Date(2025, 3, 1, 0, 0, 0, 0, paris).Unix(),
+			time.Date(2025, 4, 1, 0, 0, 0, 0, paris).Unix(),
+			31*24*time.Hour - time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.b.floor(tt.t); got != tt.floor {
+			t.Errorf("%s: floor(%d) = %d, want %d", tt.name, tt.t, got, tt.floor)
+		}
+		got := tt.b.next(tt.t)
+		if got != tt.next {
+			t.Errorf("%s: next(%d) = %d, want %d", tt.name, tt.t, got, tt.next)
+		}
+		if tt.nextAfter != 0 && time.Duration(got-tt.floor)*time.Second != tt.nextAfter {
+			t.Errorf("%s: bucket of %s, want %s", tt.name, time.Duration(got-tt.floor)*time.Second, tt.nextAfter)
+		}
+		if f := tt.b.floor(got); f != got {
+			t.Errorf("%s: next(%d) = %d is not a bucket start, floor %d", tt.name, tt.t, got, f)
+		}
+	}
+}
+
+func TestAlignedOn(t *testing.T) {
+	tests := []struct {
+		name string
+		b    bucketer
+		src  bucketer
+		want bool
+	}{
+		{"hour on 5 minutes", mustBucketer(t, 3600, "", ""), mustBucketer(t, 300, "", ""), true},
+		{"hour on 7 minutes", mustBucketer(t, 3600, "", ""), mustBucketer(t, 420, "", ""), false},
+		{"utc day on hour", mustBucketer(t, 1, "day", "UTC"), mustBucketer(t, 3600, "", ""), true},
+		{"paris day on hour", mustBucketer(t, 1, "day", "Europe/Paris"), mustBucketer(t, 3600, "", ""), true},
+		{"paris day on 2 hours", mustBucketer(t, 1, "day", "Europe/Paris"), mustBucketer(t, 7200, "", ""), false},
+		{"kolkata day on hour", mustBucketer(t, 1, "day", "Asia/Kolkata"), mustBucketer(t, 3600, "", ""), false},
+		{"kolkata day on half hour", mustBucketer(t, 1, "day", "Asia/Kolkata"), mustBucketer(t, 1800, "", ""), true},
+		{"lord howe day on half hour", mustBucketer(t, 1, "day", "Australia/Lord_Howe"), mustBucketer(t, 1800, "", ""), true},
+		{"lord howe day on hour", mustBucketer(t, 1, "day", "Australia/Lord_Howe"), mustBucketer(t, 3600, "", ""), false},
+		{"day on 7 seconds", mustBucketer(t, 1, "day", "UTC"), mustBucketer(t, 7, "", ""), false},
+		{"month on day", mustBucketer(t, 1, "month", "UTC"), mustBucketer(t, 1, "day", "UTC"), true},
+		{"week on day", mustBucketer(t, 1, "week", "UTC"), mustBucketer(t, 1, "day", "UTC"), true},
+		{"month on 2 days", mustBucketer(t, 1, "month", "UTC"), mustBucketer(t, 2, "day", "UTC"), false},
+		{"2 weeks on week", mustBucketer(t, 2, "week", "UTC"), mustBucketer(t, 1, "week", "UTC"), true},
+		{"3 days on 2 days", mustBucketer(t, 3, "day", "UTC"), mustBucketer(t, 2, "day", "UTC"), false},
+		{"month on week", mustBucketer(t, 1, "month", "UTC"), mustBucketer(t, 1, "week", "UTC"), false},
+		{"other zones", mustBucketer(t, 1, "month", "Europe/Paris"), mustBucketer(t, 1, "day", "UTC"), false},
+		{"seconds on day", mustBucketer(t, 86400, "", ""), mustBucketer(t, 1, "day", "UTC"), false},
+	}
+	for _, tt := range tests {
+		if got := alignedOn(tt.b, tt.src); got != tt.want {
+			t.Errorf("%s: alignedOn(%s, %s) = %v, want %v", tt.name, tt.b, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestZoneOffsets(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		zone string
+		want []int
+	}{
+		{"UTC", []int{0}},
+		{"Europe/Paris", []int{3600, 7200}},
+		{"Asia/Kolkata", []int{19800}},
+		{"Australia/Lord_Howe", []int{39600, 37800}},
+	}
+	for _, tt := range tests {
+		got := zoneOffsets(mustLoad(t, tt.zone), from, to)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("zoneOffsets(%s) = %v, want %v", tt.zone, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Capture files are gzipped json lines, one line per received message,
+// the payload is base64 encoded
+const (
+	capturePrefix = "mqtt2sql-capture-"
+	captureLayout = "20060102T150405"
+)
+
+type CaptureOptions struct {
+	Rotate  time.Duration // age of a file before rotation
+	MaxSize int64         // uncompressed size of a file before rotation
+	Keep    int           // number of files kept, 0 to keep them all
+}
+
+type captureRecord struct {
+	Topic    string    `json:"topic"`
+	QoS      byte      `json:"qos"`
+	Retained bool      `json:"retained"`
+	Received time.Time `json:"received"`
+	Payload  []byte    `json:"payload"`
+}
+
+type captureFile struct {
+	file    *os.File
+	gz      *gzip.Writer
+	opened  time.Time
+	written int64
+}
+
+type replayClock struct {
+	speed float64
+	first time.Time
+	start time.Time
+}
+
+// CaptureHandler writes every message to the capture files in dir and
+// forwards it unchanged
+func CaptureHandler(ich <-chan Message, dir string, opts CaptureOptions) chan Message {
+	q := newQueue[Message]("capture")
+
+	go func() {
+		defer q.close()
+		var cf *captureFile
+		defer func() { cf.close() }()
+
+		flush := time.NewTicker(5 * time.Second)
+		defer flush.Stop()
+
+		for {
+			select {
+			case msg, ok := <-ich:
+				if !ok {
+					return
+				}
+				if cf != nil && (time.Since(cf.opened) >= opts.Rotate && opts.Rotate > 0 || opts.MaxSize > 0 && cf.written >= opts.MaxSize) {
+					cf.close()
+					cf = nil
+				}
+				if cf == nil {
+					cf = newCaptureFile(dir, opts.Keep)
+				}
+				cf.write(&msg)
+				q.push(msg)
+			case <-flush.C:
+				if cf != nil {
+					cf.gz.Flush()
+				}
+			}
+		}
+	}()
+
+	return q.c
+}
+
+func newCaptureFile(dir string, keep int) *captureFile {
+	now := time.Now()
+	filename := filepath.Join(dir, capturePrefix+now.UTC().Format(captureLayout)+".jsonl.gz")
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Capture open", "filename", filename, "error", err)
+		return nil
+	}
+	slog.Info("Capturing", "filename", filename)
+
+	if keep > 0 {
+		files, _ := filepath.Glob(filepath.Join(dir, capturePrefix+"*"))
+		slices.Sort(files)
+		for len(files) > keep {
+			if err := os.Remove(files[0]); err != nil {
+				slog.Warn("Capture remove", "filename", files[0], "error", err)
+			} else {
+				slog.Info("Capture removed", "filename", files[0])
+			}
+			files = files[1:]
+		}
+	}
+
+	return &captureFile{file: file, gz: gzip.NewWriter(file), opened: now}
+}
+
+func (cf *captureFile) write(msg *Message) {
+	if cf == nil {
+		return
+	}
+	buff, _ := json.Marshal(captureRecord{
+		Topic:    msg.Topic,
+		QoS:      msg.QoS,
+		Retained: msg.Retained,
+		Received: msg.Received,
+		Payload:  msg.Payload,
+	})
+	buff = append(buff, '\n')
+	if _, err := cf.gz.Write(buff); err != nil {
+		slog.Error("Capture write", "filename", cf.file.Name(), "error", err)
+	}
+	cf.written += int64(len(buff))
+}
+
+func (cf *captureFile) close() {
+	if cf == nil {
+		return
+	}
+	if err := cf.gz.Close(); err != nil {
+		slog.Error("Capture close", "filename", cf.file.Name(), "error", err)
+	}
+	cf.file.Close()
+}
+
+// readCapture feeds the captured messages back, paced by the clock
+func readCapture(ctx context.Context, filename string, r io.Reader, clock *replayClock, q *queue[Message]) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for ctx.Err() == nil && scanner.Scan() {
+		var rec captureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			slog.Warn("Capture record skipped", "filename", filename, "error", err)
+			continue
+		}
+		clock.wait(ctx, rec.Received)
+		slog.Debug("Capture replayed", "topic", rec.Topic, "received", rec.Received)
+		q.push(Message{
+			Topic:    rec.Topic,
+			Payload:  rec.Payload,
+			QoS:      rec.QoS,
+			Retained: rec.Retained,
+			Received: rec.Received,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("Capture reader", "filename", filename, "error", err)
+	}
+}
+
+// wait sleeps until the message received at t is due, relative to the
+// first message replayed
+func (clock *replayClock) wait(ctx context.Context, t time.Time) {
+	if clock.speed <= 0 {
+		return
+	}
+	if clock.first.IsZero() {
+		clock.first, clock.start = t, time.Now()
+		return
+	}
+	due := clock.start.Add(time.Duration(float64(t.Sub(clock.first)) / clock.speed))
+	if d := time.Until(due); d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+}
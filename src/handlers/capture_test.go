@@ -0,0 +1,85 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReplayTimestamps(t *testing.T) {
+	defer mapping.Store(nil)
+
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "mapping.json")
+	if err := os.WriteFile(rules, []byte(`{"rules": [{"topic": "tele/+/SENSOR", "tags": {"id": "{1}"}, "values": [{"measurement": "t", "value": "$.t"}]}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadMapping(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	// captured a day ago, one minute apart
+	captured := time.Now().Add(-24 * time.Hour).Truncate(time.Millisecond)
+	msgs := []Message{
+		{Topic: "tele/kitchen/SENSOR", Payload: []byte(`{"t": 21.5}`)},
+		{Topic: "spBv1.0/plant/NBIRTH/edge1", Payload: testPayload(0, 0,
+			testMetric{name: "bdSeq", datatype: spUInt64},
+			testMetric{name: "Supply Voltage", alias: 1, datatype: spFloat, float: 12.5},
+		)},
+		{Topic: "spBv1.0/plant/NDEATH/edge1", Payload: testPayload(0, 0,
+			testMetric{name: "bdSeq", datatype: spUInt64},
+		)},
+		// the timestamps of the payloads are kept
+		{Topic: "sensors", Payload: []byte(`{"measurement": "t", "tags": {"id": "a"}, "fields": {"value": 1}, "timestamp": 1000}`)},
+	}
+	ich := make(chan Message)
+	och := CaptureHandler(ich, dir, CaptureOptions{})
+	go func() {
+		for i, msg := range msgs {
+			msg.Received = captured.Add(time.Duration(i) * time.Minute)
+			ich <- msg
+		}
+		close(ich)
+	}()
+	for range och {
+	}
+
+	type point struct {
+		measurement string
+		ts          int64
+	}
+	var got []point
+	for dp := range JSONHandler(FileHandler(t.Context(), filepath.Join(dir, capturePrefix+"*"), FileFormat{Format: "capture"})) {
+		got = append(got, point{dp.Measurement, dp.Timestamp})
+	}
+	at := func(i int) int64 { return captured.Add(time.Duration(i) * time.Minute).UnixMilli() }
+	want := []point{
+		{"t", at(0)},
+		{statusMeasurement, at(1)},
+		{"supply_voltage", at(1)},
+		{statusMeasurement, at(2)},
+		{"t", 1000},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
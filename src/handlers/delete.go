@@ -0,0 +1,191 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// deletePolicy splits the large deletes, of the retention and of the
+// consolidated source data, in chunks of rows or of time paused between
+// them, so that the inserts are not locked out and the undo log stays
+// small
+type deletePolicy struct {
+	rows     int64 // rows per chunk, 0 for no limit
+	slice    int64 // seconds per chunk, 0 for no limit
+	pause    time.Duration
+	deferred bool // source data deleted once the consolidation committed
+}
+
+const deleteProgress = 10 * time.Second
+
+var (
+	deleteMu sync.Mutex
+	deletes  = deletePolicy{rows: 10000}
+)
+
+// SetDeletePolicy changes how the deletes are split, chunk being a row
+// count or a duration, 0 for single statements, and whether the source
+// data is deleted out of the consolidation transaction
+func SetDeletePolicy(chunk string, pause time.Duration, deferred bool) error {
+	p, err := parseDeletePolicy(chunk, pause)
+	if err != nil {
+		return err
+	}
+	p.deferred = deferred
+
+	deleteMu.Lock()
+	deletes = p
+	deleteMu.Unlock()
+	return nil
+}
+
+// CheckDeletePolicy tells whether SetDeletePolicy would accept the chunk
+// and the pause
+func CheckDeletePolicy(chunk string, pause time.Duration) error {
+	_, err := parseDeletePolicy(chunk, pause)
+	return err
+}
+
+func parseDeletePolicy(chunk string, pause time.Duration) (deletePolicy, error) {
+	var p deletePolicy
+	if n, err := strconv.ParseInt(chunk, 10, 64); err == nil {
+		if n < 0 {
+			return p, fmt.Errorf("bad delete chunk %q", chunk)
+		}
+		p.rows = n
+	} else if d, err := time.ParseDuration(chunk); err == nil && d >= time.Second {
+		p.slice = int64(d / time.Second)
+	} else {
+		return p, fmt.Errorf("bad delete chunk %q, expected a row count or a duration of at least 1s", chunk)
+	}
+	if pause < 0 {
+		return p, fmt.Errorf("bad delete pause %s", pause)
+	}
+	p.pause = pause
+	return p, nil
+}
+
+func getDeletePolicy() deletePolicy {
+	deleteMu.Lock()
+	defer deleteMu.Unlock()
+	return deletes
+}
+
+// withContext returns a DB out of any transaction whose statements are
+// cancelled when the context is done
+func (db *DB) withContext(ctx context.Context) *DB {
+	return &DB{DB: db.DB, ctx: ctx}
+}
+
+// DeleteData deletes the rows of [t1, t2) selected by the filter, if
+// any, by chunks as set by SetDeletePolicy. Within a transaction the
+// chunks would only hold the locks longer, the rows are deleted at once
+func (db *DB) DeleteData(table string, t1 int64, t2 int64, f *Filter) bool {
+	_, ok := db.deleteData(table, t1, t2, f)
+	return ok
+}
+
+func (db *DB) deleteData(table string, t1 int64, t2 int64, f *Filter) (int64, bool) {
+	cmdTemplate := `
+	DELETE FROM %s WHERE ts >= %d AND ts < %d%s%s;
+	`
+	p := getDeletePolicy()
+	if db.tx != nil {
+		p = deletePolicy{}
+	}
+	ctx := db.execContext()
+	filter, args := f.where()
+	start := time.Now()
+	progress := start
+	var total int64
+
+	exec := func(t1 int64, t2 int64, limit string) (int64, bool) {
+		cmd := fmt.Sprintf(cmdTemplate, table, t1, t2, filter, limit)
+		result, err := db.Exec(cmd, args...)
+		if err != nil {
+			slog.Error("Delete error", "table", table, "cmd", cmd, "err", err)
+			return 0, false
+		}
+		affected, _ := result.RowsAffected()
+		total += affected
+		if time.Since(progress) >= deleteProgress {
+			progress = time.Now()
+			slog.Info("Deleting", "table", table, "ts", t1, "affected rows", total, "elapsed", time.Since(start).Round(time.Second).String())
+		}
+		return affected, true
+	}
+	// the pause is skipped after the last chunk
+	pause := func() bool {
+		if p.pause == 0 {
+			return ctx.Err() == nil
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(p.pause):
+			return true
+		}
+	}
+
+	switch {
+	case p.slice > 0:
+		if t1 == 0 {
+			mints, ok := db.ReadMinTimestamp(table)
+			if !ok {
+				return 0, true
+			}
+			t1 = int64(mints) / p.slice * p.slice
+		}
+		for t := t1; t < t2; t += p.slice {
+			if t > t1 && !pause() {
+				slog.Warn("Delete interrupted", "table", table, "ts", t, "affected rows", total)
+				return total, false
+			}
+			if _, ok := exec(t, min(t+p.slice, t2), ""); !ok {
+				return total, false
+			}
+		}
+	case p.rows > 0:
+		for first := true; ; first = false {
+			if !first && !pause() {
+				slog.Warn("Delete interrupted", "table", table, "affected rows", total)
+				return total, false
+			}
+			n, ok := exec(t1, t2, fmt.Sprintf(" ORDER BY ts LIMIT %d", p.rows))
+			if !ok {
+				return total, false
+			}
+			if n < p.rows {
+				break
+			}
+		}
+	default:
+		if _, ok := exec(t1, t2, ""); !ok {
+			return total, false
+		}
+	}
+
+	slog.Info("Deleted", "table", table, "t1", t1, "t2", t2, "affected rows", total, "elapsed", time.Since(start).Round(time.Millisecond).String())
+	return total, true
+}
@@ -0,0 +1,129 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSetDeletePolicy(t *testing.T) {
+	defer SetDeletePolicy("10000", 0, false)
+
+	tests := []struct {
+		chunk string
+		pause time.Duration
+		want  deletePolicy
+		err   bool
+	}{
+		{"10000", 0, deletePolicy{rows: 10000}, false},
+		{"0", time.Second, deletePolicy{pause: time.Second}, false},
+		{"1h", 0, deletePolicy{slice: 3600}, false},
+		{"-1", 0, deletePolicy{}, true},
+		{"500ms", 0, deletePolicy{}, true},
+		{"many", 0, deletePolicy{}, true},
+		{"100", -time.Second, deletePolicy{}, true},
+	}
+	for _, tt := range tests {
+		err := SetDeletePolicy(tt.chunk, tt.pause, false)
+		if (err != nil) != tt.err {
+			t.Errorf("SetDeletePolicy(%q, %s) error %v, want error %v", tt.chunk, tt.pause, err, tt.err)
+			continue
+		}
+		if got := getDeletePolicy(); !tt.err && got != tt.want {
+			t.Errorf("SetDeletePolicy(%q, %s) = %+v, want %+v", tt.chunk, tt.pause, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteData(t *testing.T) {
+	defer SetDeletePolicy("10000", 0, false)
+
+	tests := []struct {
+		name  string
+		chunk string
+		pause time.Duration
+		tx    bool
+		// the context of the statements expires after timeout, if any
+		timeout time.Duration
+		t1, t2  int64
+		want    []string
+		ok      bool
+	}{
+		{"single", "0", 0, false, 0, 7200, 18000, []string{
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 18000;",
+		}, true},
+		{"rows", "100", 0, false, 0, 7200, 18000, []string{
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 18000 ORDER BY ts LIMIT 100;",
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 18000 ORDER BY ts LIMIT 100;",
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 18000 ORDER BY ts LIMIT 100;",
+		}, true},
+		{"slices", "1h", 0, false, 0, 7200, 16000, []string{
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 10800;",
+			"DELETE FROM t WHERE ts >= 10800 AND ts < 14400;",
+			"DELETE FROM t WHERE ts >= 14400 AND ts < 16000;",
+		}, true},
+		// the first slice starts with the oldest row
+		{"slices from the start", "1h", 0, false, 0, 0, 10000, []string{
+			"DELETE FROM t WHERE ts >= 3600 AND ts < 7200;",
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 10000;",
+		}, true},
+		{"within a transaction", "100", time.Second, true, 0, 7200, 18000, []string{
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 18000;",
+		}, true},
+		{"interrupted", "100", time.Hour, false, 50 * time.Millisecond, 7200, 18000, []string{
+			"DELETE FROM t WHERE ts >= 7200 AND ts < 18000 ORDER BY ts LIMIT 100;",
+		}, false},
+	}
+	for _, tt := range tests {
+		if err := SetDeletePolicy(tt.chunk, tt.pause, false); err != nil {
+			t.Fatal(err)
+		}
+		f, db := newFakeDB(t)
+		f.on(`^DELETE`, fakeReply{affected: 100, times: 2})
+		f.on(`^DELETE`, fakeReply{affected: 40})
+		f.on(`^SELECT min\(ts\) FROM t;$`, fakeReply{cols: []string{"ts"}, rows: [][]driver.Value{{5000.0}}})
+		ctx := context.Background()
+		if tt.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+			defer cancel()
+		}
+		db = db.withContext(ctx)
+		if tt.tx {
+			var ok bool
+			if db, ok = db.BeginTransaction(ctx); !ok {
+				t.Fatal("no transaction")
+			}
+		}
+		_, ok := db.deleteData("t", tt.t1, tt.t2, nil)
+		if ok != tt.ok {
+			t.Errorf("%s: deleteData %v, want %v", tt.name, ok, tt.ok)
+		}
+		var got []string
+		for _, c := range f.executed(`^DELETE`) {
+			got = append(got, c.query)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: deleted by\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
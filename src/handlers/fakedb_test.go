@@ -0,0 +1,192 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver for the tests: a statement matching
+// the pattern of a reply gets its rows or its error, the others succeed
+// without rows. Every statement is recorded
+type fakeDB struct {
+	mu      sync.Mutex
+	replies []fakeReply
+	calls   []fakeCall
+}
+
+type fakeReply struct {
+	re       *regexp.Regexp
+	cols     []string
+	rows     [][]driver.Value
+	affected int64
+	lastID   int64
+	err      error
+	// block waits for the context of the statement to be done
+	block bool
+	// times limits the statements answered, 0 for no limit
+	times int
+	used  int
+}
+
+type fakeCall struct {
+	query string
+	args  []driver.Value
+}
+
+// newFakeDB returns a DB using a fakeDB, closed when the test ends
+func newFakeDB(t *testing.T) (*fakeDB, *DB) {
+	f := &fakeDB{}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return f, &DB{DB: db}
+}
+
+// on adds a reply to the statements matching pattern, the first reply
+// added, and not used up, wins
+func (f *fakeDB) on(pattern string, r fakeReply) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r.re = regexp.MustCompile(pattern)
+	f.replies = append(f.replies, r)
+}
+
+// executed returns the statements run so far matching pattern, with
+// their white spaces squeezed
+func (f *fakeDB) executed(pattern string) []fakeCall {
+	re := regexp.MustCompile(pattern)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []fakeCall
+	for _, c := range f.calls {
+		if re.MatchString(c.query) {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func (f *fakeDB) run(ctx context.Context, query string, args []driver.NamedValue) (fakeReply, error) {
+	query = strings.Join(strings.Fields(query), " ")
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{query, values})
+	var reply fakeReply
+	for i, r := range f.replies {
+		if r.re.MatchString(query) && (r.times == 0 || r.used < r.times) {
+			f.replies[i].used++
+			reply = r
+			break
+		}
+	}
+	f.mu.Unlock()
+	if reply.block {
+		<-ctx.Done()
+		return reply, ctx.Err()
+	}
+	return reply, reply.err
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ f *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.f, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.f.run(context.Background(), "BEGIN", nil)
+	return fakeTx(c), nil
+}
+
+type fakeTx struct{ f *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	_, err := tx.f.run(context.Background(), "COMMIT", nil)
+	return err
+}
+
+func (tx fakeTx) Rollback() error {
+	_, err := tx.f.run(context.Background(), "ROLLBACK", nil)
+	return err
+}
+
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	panic("not used, ExecContext is")
+}
+
+func (s fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	panic("not used, QueryContext is")
+}
+
+func (s fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	r, err := s.f.run(ctx, s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{r.lastID, r.affected}, nil
+}
+
+type fakeResult struct{ lastID, affected int64 }
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.lastID, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.affected, nil }
+
+func (s fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	r, err := s.f.run(ctx, s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{cols: r.cols, rows: r.rows}, nil
+}
+
+type fakeRows struct {
+	cols []string
+	rows [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.cols }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -19,37 +19,289 @@ package handlers
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 )
 
-func FileHandler(filename string) chan string {
-	c := make(chan string, 10)
+// FileFormat describes the content of the input files, json lines are
+// either arrays of datapoints or single datapoints (ndjson), csv rows
+// are mapped on datapoints with Columns and capture files are the ones
+// written by CaptureHandler
+type FileFormat struct {
+	Format      string   // json, ndjson, csv, capture or empty to guess from the file name
+	Columns     []string // timestamp, id, value, measurement, name, place, or empty to skip
+	Measurement string   // used when there is no measurement column
+	Speed       float64  // capture replay speed, 1 for real time, 0 for as fast as possible
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	csvFields = []string{"", "timestamp", "id", "value", "measurement", "name", "place"}
+)
+
+// FileHandler reads a file, the files of a directory or the files
+// matching a glob pattern, in name order, until the context is done.
+// The format is the one checked by Check
+func FileHandler(ctx context.Context, pattern string, ff FileFormat) chan Message {
+	q := newQueue[Message]("file")
 
 	go func() {
-		defer close(c)
-		file := os.Stdin
-		var err error
+		defer q.close()
 
-		if filename != "-" {
-			file, err = os.Open(filename)
-			if err != nil {
-				slog.Error("File open", "filename", filename, "error", err)
+		files, err := inputFiles(pattern)
+		if err != nil {
+			slog.Error("File open", "filename", pattern, "error", err)
+			return
+		}
+
+		clock := &replayClock{speed: ff.Speed}
+		for _, filename := range files {
+			if ctx.Err() != nil {
+				slog.Info("File reading interrupted", "filename", filename)
 				return
 			}
-			defer file.Close()
+			readFile(ctx, filename, ff, clock, q)
 		}
+	}()
+
+	return q.c
+}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			msg := scanner.Text()
-			slog.Debug("File scanner", "payload", msg)
-			c <- msg
+// Check tells whether the files matching the pattern can be read with
+// the format: the csv rows need a measurement column or a measurement
+func (ff FileFormat) Check(pattern string) error {
+	for _, col := range ff.Columns {
+		if !slices.Contains(csvFields, col) {
+			return fmt.Errorf("unknown csv column %q", col)
 		}
-		if err := scanner.Err(); err != nil {
-			slog.Error("File scanner", "error", err)
+	}
+	if ff.Measurement != "" || slices.Contains(ff.Columns, "measurement") {
+		return nil
+	}
+	csvFiles := ff.Format == "csv"
+	if ff.Format == "" {
+		files, err := inputFiles(pattern)
+		if err != nil {
+			return err
 		}
-	}()
+		csvFiles = slices.ContainsFunc(files, func(f string) bool { return guessFormat(f) == "csv" })
+	}
+	if csvFiles {
+		return fmt.Errorf("csv rows without measurement, add a measurement column or set the measurement")
+	}
+	return nil
+}
+
+func inputFiles(pattern string) ([]string, error) {
+	if pattern == "-" {
+		return []string{pattern}, nil
+	}
+
+	var candidates []string
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		entries, err := os.ReadDir(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			candidates = append(candidates, filepath.Join(pattern, e.Name()))
+		}
+	} else if err == nil {
+		return []string{pattern}, nil
+	} else if candidates, err = filepath.Glob(pattern); err != nil {
+		return nil, err
+	}
+
+	// the modification times are lost by a copy, the names are kept:
+	// the files are read in name order, dated names sort by date
+	var files []string
+	for _, name := range candidates {
+		if info, err := os.Stat(name); err == nil && info.Mode().IsRegular() {
+			files = append(files, name)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no file found")
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+func readFile(ctx context.Context, filename string, ff FileFormat, clock *replayClock, q *queue[Message]) {
+	r, closer, err := openInput(filename)
+	if err != nil {
+		slog.Error("File open", "filename", filename, "error", err)
+		return
+	}
+	defer closer()
+	slog.Info("Reading", "filename", filename)
+
+	format := ff.Format
+	if format == "" {
+		format = guessFormat(filename)
+	}
+	switch format {
+	case "csv":
+		readCSV(ctx, filename, r, ff, q)
+		return
+	case "capture":
+		readCapture(ctx, filename, r, clock, q)
+		return
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for ctx.Err() == nil && scanner.Scan() {
+		msg := scanner.Text()
+		if strings.TrimSpace(msg) == "" {
+			continue
+		}
+		slog.Debug("File scanner", "payload", msg)
+		q.push(Message{Payload: []byte(msg)})
+	}
+	if err := scanner.Err(); err != nil {
+		slog.Error("File scanner", "filename", filename, "error", err)
+	}
+}
+
+// openInput opens a file or stdin and uncompresses it when needed
+func openInput(filename string) (io.Reader, func(), error) {
+	file := os.Stdin
+	var err error
+
+	if filename != "-" {
+		file, err = os.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	closers := []func(){func() { file.Close() }}
+	closer := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		closers = append(closers, func() { gz.Close() })
+		return gz, closer, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			closer()
+			return nil, nil, err
+		}
+		closers = append(closers, zr.Close)
+		return zr, closer, nil
+	}
+	return br, closer, nil
+}
+
+func guessFormat(filename string) string {
+	name := strings.ToLower(filename)
+	for _, ext := range []string{".gz", ".zst", ".zstd"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if strings.HasPrefix(filepath.Base(name), capturePrefix) {
+		return "capture"
+	}
+	if filepath.Ext(name) == ".csv" {
+		return "csv"
+	}
+	return "json"
+}
+
+// readCSV turns the rows into single datapoints handed over to
+// JSONHandler, a first row which does not parse is taken as a header
+func readCSV(ctx context.Context, filename string, r io.Reader, ff FileFormat, q *queue[Message]) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.Comment = '#'
+	cr.TrimLeadingSpace = true
+
+	for line := 1; ctx.Err() == nil; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			slog.Error("CSV reader", "filename", filename, "error", err)
+			return
+		}
+		dp, err := csvDatapoint(record, ff)
+		if err != nil {
+			if line == 1 {
+				slog.Debug("CSV header skipped", "filename", filename, "record", record)
+			} else {
+				slog.Warn("CSV row skipped", "filename", filename, "line", line, "error", err)
+			}
+			continue
+		}
+		buff, _ := json.Marshal(dp)
+		slog.Debug("CSV reader", "payload", string(buff))
+		q.push(Message{Payload: buff})
+	}
+}
+
+func csvDatapoint(record []string, ff FileFormat) (*Datapoint, error) {
+	dp := &Datapoint{Measurement: ff.Measurement}
+	hasValue, hasTimestamp := false, false
+
+	for i, col := range ff.Columns {
+		if i >= len(record) {
+			break
+		}
+		field := strings.TrimSpace(record[i])
+		switch col {
+		case "timestamp":
+			ts, ok := parseTimestamp(field, "")
+			if !ok {
+				return nil, fmt.Errorf("bad timestamp %q", field)
+			}
+			dp.Timestamp = ts
+			hasTimestamp = true
+		case "value":
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value %q", field)
+			}
+			dp.Fields.Value = v
+			hasValue = true
+		case "id":
+			dp.Tags.ID = field
+		case "measurement":
+			dp.Measurement = field
+		case "name":
+			dp.Tags.Name = field
+		case "place":
+			dp.Tags.Place = field
+		}
+	}
 
-	return c
+	dp.Measurement = measurementName(dp.Measurement)
+	if !hasValue || !hasTimestamp || dp.Measurement == "" {
+		return nil, fmt.Errorf("missing timestamp, value or measurement")
+	}
+	return dp, nil
 }
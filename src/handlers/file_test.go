@@ -0,0 +1,107 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFileFormatCheck(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"data.csv.gz", "data.json"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	csvFile := filepath.Join(dir, "data.csv.gz")
+	jsonFile := filepath.Join(dir, "data.json")
+	tests := []struct {
+		name    string
+		ff      FileFormat
+		pattern string
+		err     bool
+	}{
+		{"guessed json", FileFormat{Columns: []string{"timestamp", "id", "value"}}, jsonFile, false},
+		{"guessed csv", FileFormat{Columns: []string{"timestamp", "id", "value"}}, csvFile, true},
+		{"csv in a directory", FileFormat{Columns: []string{"timestamp", "id", "value"}}, dir, true},
+		{"csv format", FileFormat{Format: "csv", Columns: []string{"timestamp", "id", "value"}}, jsonFile, true},
+		{"ndjson format", FileFormat{Format: "ndjson", Columns: []string{"timestamp", "id", "value"}}, csvFile, false},
+		{"measurement column", FileFormat{Format: "csv", Columns: []string{"timestamp", "measurement", "", "value"}}, csvFile, false},
+		{"measurement", FileFormat{Format: "csv", Columns: []string{"timestamp", "id", "value"}, Measurement: "t"}, csvFile, false},
+		{"unknown column", FileFormat{Format: "csv", Columns: []string{"timestamp", "unit", "value"}, Measurement: "t"}, csvFile, true},
+		{"no file", FileFormat{Columns: []string{"timestamp", "id", "value"}}, filepath.Join(dir, "*.ndjson"), true},
+	}
+	for _, tt := range tests {
+		if err := tt.ff.Check(tt.pattern); (err != nil) != tt.err {
+			t.Errorf("%s: Check error %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	// the modification times are the reverse of the names, as after a copy
+	names := []string{"2025-03-02.ndjson", "2025-03-01.ndjson.gz", "2025-02-28.csv"}
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "2025-03-03"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	in := func(names ...string) []string {
+		for i, name := range names {
+			names[i] = filepath.Join(dir, name)
+		}
+		return names
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+		err     bool
+	}{
+		{"directory", dir, in("2025-02-28.csv", "2025-03-01.ndjson.gz", "2025-03-02.ndjson"), false},
+		{"glob", filepath.Join(dir, "*.ndjson*"), in("2025-03-01.ndjson.gz", "2025-03-02.ndjson"), false},
+		{"file", filepath.Join(dir, "2025-03-02.ndjson"), in("2025-03-02.ndjson"), false},
+		{"stdin", "-", []string{"-"}, false},
+		{"nothing", filepath.Join(dir, "*.json"), nil, true},
+		{"bad glob", filepath.Join(dir, "["), nil, true},
+	}
+	for _, tt := range tests {
+		got, err := inputFiles(tt.pattern)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: inputFiles error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: inputFiles = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// Filter selects the sensors consolidated by a dispatching rule, the
+// criteria are combined with AND, the values of a criterion with OR.
+// The names and places are glob patterns, * and ? being the wildcards:
+//
+//	filter:
+//	  sensors: [t12, t13]
+//	  names: ["temp*"]
+//	  places: ["outdoor*", garden]
+//	  tags:
+//	    - {tag: place, op: "!=", value: garage}
+//	    - {tag: id, op: "~", value: "^0x[0-9a-f]+$"}
+type Filter struct {
+	Sensors []string    `yaml:"sensors,omitempty" json:"sensors,omitempty"`
+	Names   []string    `yaml:"names,omitempty" json:"names,omitempty"`
+	Places  []string    `yaml:"places,omitempty" json:"places,omitempty"`
+	Tags    []Predicate `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// Predicate compares a tag, id, name or place, to a value with =, !=,
+// like, !like (glob patterns), ~ or !~ (regular expressions). The
+// regular expressions are run by the REGEXP of the database, PCRE, they
+// have to be valid for Go too, the syntax common to both
+type Predicate struct {
+	Tag   string `yaml:"tag" json:"tag"`
+	Op    string `yaml:"op" json:"op"`
+	Value string `yaml:"value" json:"value"`
+}
+
+const maxFilterValue = 255
+
+var (
+	tagColumns = map[string]string{"id": "sensorid", "name": "name", "place": "place"}
+	// the negations keep the rows whose tag is NULL
+	predicateOps = map[string]string{
+		"=":     "%s = ?",
+		"!=":    "NOT (%s <=> ?)",
+		"like":  "%s LIKE ?",
+		"!like": "(%[1]s IS NULL OR %[1]s NOT LIKE ?)",
+		"~":     "%s REGEXP ?",
+		"!~":    "(%[1]s IS NULL OR %[1]s NOT REGEXP ?)",
+	}
+)
+
+// ParseFilter parses a filter stored in JSON, an empty string is no filter
+func ParseFilter(s string) (*Filter, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var f Filter
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("bad filter: %w", err)
+	}
+	if f.empty() {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+// String returns the filter in JSON, an empty string when there is none
+func (f *Filter) String() string {
+	if f.empty() {
+		return ""
+	}
+	var buff bytes.Buffer
+	enc := json.NewEncoder(&buff)
+	enc.SetEscapeHTML(false)
+	enc.Encode(f)
+	return strings.TrimSpace(buff.String())
+}
+
+func (f *Filter) empty() bool {
+	return f == nil || len(f.Sensors) == 0 && len(f.Names) == 0 && len(f.Places) == 0 && len(f.Tags) == 0
+}
+
+func (f *Filter) validate() error {
+	if f.empty() {
+		return nil
+	}
+	var values []string
+	values = append(values, f.Sensors...)
+	values = append(values, f.Names...)
+	values = append(values, f.Places...)
+	for _, p := range f.Tags {
+		if _, ok := tagColumns[p.Tag]; !ok {
+			return fmt.Errorf("filter: unknown tag %q, expected id, name or place", p.Tag)
+		}
+		if _, ok := predicateOps[p.Op]; !ok {
+			return fmt.Errorf("filter: unknown operator %q for tag %s", p.Op, p.Tag)
+		}
+		if p.Op == "~" || p.Op == "!~" {
+			if _, err := regexp.Compile(p.Value); err != nil {
+				return fmt.Errorf("filter: tag %s: %w", p.Tag, err)
+			}
+		}
+		values = append(values, p.Value)
+	}
+	for _, v := range values {
+		if v == "" {
+			return fmt.Errorf("filter: empty value")
+		}
+		if len(v) > maxFilterValue {
+			return fmt.Errorf("filter: value longer than %d bytes", maxFilterValue)
+		}
+	}
+	return nil
+}
+
+// checkPatterns checks the regular expressions of the filters of the
+// rules with the database, validate only knows the RE2 syntax of Go
+func (db *DB) checkPatterns(rules []Rule) bool {
+	ok := true
+	for _, r := range rules {
+		if r.Filter == nil {
+			continue
+		}
+		for _, p := range r.Filter.Tags {
+			if p.Op != "~" && p.Op != "!~" {
+				continue
+			}
+			var matched bool
+			if err := db.QueryRow("SELECT '' REGEXP ?;", p.Value).Scan(&matched); err != nil {
+				slog.Error("Invalid rule", "err", fmt.Errorf("%s: filter: tag %s: %w", r.Dest, p.Tag, err))
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// where returns the condition of the filter, to be appended to a WHERE
+// clause, and its arguments, the values are never part of the SQL. With
+// the sensor registry the current id, name and place of the sensors are
+// filtered
+func (f *Filter) where() (string, []any) {
+	if f.empty() {
+		return "", nil
+	}
+	var conds []string
+	var args []any
+	in := func(col string, values []string, pattern bool) {
+		if len(values) == 0 {
+			return
+		}
+		var ors []string
+		for _, v := range values {
+			if pattern {
+				ors = append(ors, col+" LIKE ?")
+				v = globToLike(v)
+			} else {
+				ors = append(ors, col+" = ?")
+			}
+			args = append(args, v)
+		}
+		conds = append(conds, "("+strings.Join(ors, " OR ")+")")
+	}
+	in("sensorid", f.Sensors, false)
+	in("name", f.Names, true)
+	in("place", f.Places, true)
+	for _, p := range f.Tags {
+		v := p.Value
+		if p.Op == "like" || p.Op == "!like" {
+			v = globToLike(v)
+		}
+		conds = append(conds, fmt.Sprintf(predicateOps[p.Op], tagColumns[p.Tag]))
+		args = append(args, v)
+	}
+	if registry.Load() {
+		return fmt.Sprintf(" AND %s IN (SELECT %s FROM %s WHERE %s)", sensorKeyCol, sensorKeyCol, sensorsTable, strings.Join(conds, " AND ")), args
+	}
+	return " AND " + strings.Join(conds, " AND "), args
+}
+
+// globToLike converts a glob pattern to a LIKE pattern, escaping the
+// LIKE wildcards
+func globToLike(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '%', '_', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,118 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter *Filter
+		err    bool
+	}{
+		{"no filter", nil, false},
+		{"empty filter", &Filter{}, false},
+		{"globs", &Filter{Sensors: []string{"t12"}, Names: []string{"temp*"}, Places: []string{"outdoor?"}}, false},
+		{"predicates", &Filter{Tags: []Predicate{{"place", "!=", "garage"}, {"name", "!like", "*test*"}, {"id", "~", "^0x[0-9a-f]+$"}}}, false},
+		{"unknown tag", &Filter{Tags: []Predicate{{"room", "=", "kitchen"}}}, true},
+		{"unknown operator", &Filter{Tags: []Predicate{{"place", "<", "garage"}}}, true},
+		{"bad regular expression", &Filter{Tags: []Predicate{{"id", "!~", "^(0x"}}}, true},
+		{"not RE2", &Filter{Tags: []Predicate{{"id", "~", "^(?!0x)"}}}, true},
+		{"empty value", &Filter{Places: []string{""}}, true},
+		{"empty predicate value", &Filter{Tags: []Predicate{{"place", "=", ""}}}, true},
+		{"value too long", &Filter{Names: []string{strings.Repeat("a", maxFilterValue+1)}}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.filter.validate(); (err != nil) != tt.err {
+			t.Errorf("%s: validate error %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestFilterWhere(t *testing.T) {
+	defer registry.Store(false)
+
+	tests := []struct {
+		name     string
+		filter   *Filter
+		registry bool
+		where    string
+		args     []any
+	}{
+		{"no filter", nil, false, "", nil},
+		{"sensors", &Filter{Sensors: []string{"t12", "t13"}}, false,
+			" AND (sensorid = ? OR sensorid = ?)", []any{"t12", "t13"}},
+		{"globs escaped", &Filter{Names: []string{"temp_*"}, Places: []string{"100%?"}}, false,
+			" AND (name LIKE ?) AND (place LIKE ?)", []any{`temp\_%`, `100\%_`}},
+		{"predicates", &Filter{Tags: []Predicate{{"place", "!=", "garage"}, {"name", "!like", "*test*"}, {"id", "~", "^0x"}, {"id", "!~", "'; DROP TABLE t; --"}}}, false,
+			" AND NOT (place <=> ?) AND (name IS NULL OR name NOT LIKE ?) AND sensorid REGEXP ? AND (sensorid IS NULL OR sensorid NOT REGEXP ?)",
+			[]any{"garage", "%test%", "^0x", "'; DROP TABLE t; --"}},
+		{"registry", &Filter{Places: []string{"garden"}, Tags: []Predicate{{"id", "=", "t12"}}}, true,
+			" AND sensor_key IN (SELECT sensor_key FROM sensors WHERE (place LIKE ?) AND sensorid = ?)", []any{"garden", "t12"}},
+	}
+	for _, tt := range tests {
+		registry.Store(tt.registry)
+		where, args := tt.filter.where()
+		if where != tt.where {
+			t.Errorf("%s: where %q, want %q", tt.name, where, tt.where)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%s: args %q, want %q", tt.name, args, tt.args)
+		}
+		// the values are placeholders only
+		if n := strings.Count(where, "?"); n != len(args) {
+			t.Errorf("%s: %d placeholders for %d args", tt.name, n, len(args))
+		}
+	}
+}
+
+func TestCheckPatterns(t *testing.T) {
+	rules := []Rule{
+		{Dest: "a", Filter: &Filter{Tags: []Predicate{{"id", "~", "^0x"}, {"place", "=", "garage"}}}},
+		{Dest: "b"},
+		{Dest: "c", Filter: &Filter{Tags: []Predicate{{"name", "!~", `\btemp`}}}},
+	}
+	tests := []struct {
+		name  string
+		reply error
+		want  bool
+	}{
+		{"valid", nil, true},
+		{"rejected by the database", errors.New("Regex error"), false},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		f.on(`^SELECT '' REGEXP \?;$`, fakeReply{cols: []string{"m"}, rows: [][]driver.Value{{int64(0)}}, err: tt.reply})
+		if got := db.checkPatterns(rules); got != tt.want {
+			t.Errorf("%s: checkPatterns = %v, want %v", tt.name, got, tt.want)
+		}
+		var patterns []driver.Value
+		for _, c := range f.executed(`REGEXP`) {
+			patterns = append(patterns, c.args...)
+		}
+		if want := []driver.Value{"^0x", `\btemp`}; !reflect.DeepEqual(patterns, want) {
+			t.Errorf("%s: patterns checked %q, want %q", tt.name, patterns, want)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The dispatching items form a graph, from their source table to their
+// destination table. An item reads a measurement table or the table of
+// another item, it runs after it. The rank only orders the independent
+// items; the items sharing tables form a branch, the branches run in
+// parallel
+
+// orderItems returns the valid items in topological order and the
+// reasons of the rejection of the other items
+func orderItems(items []Item) ([]Item, []error) {
+	var errs []error
+	reject := func(item Item, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", item.dst, err))
+	}
+
+	producers := make(map[string]int)
+	var candidates []Item
+	for _, item := range items {
+		if _, dup := producers[item.dst]; dup {
+			reject(item, fmt.Errorf("duplicate destination table"))
+			continue
+		}
+		producers[item.dst] = len(candidates)
+		candidates = append(candidates, item)
+	}
+
+	// the sources are measurement tables or tables of other items
+	measurements := strings.TrimSuffix(measurementTmpl, "%s")
+	pending := make([]int, len(candidates))
+	dependents := make([][]int, len(candidates))
+	for i, item := range candidates {
+		if p, ok := producers[item.src]; ok {
+			pending[i] = 1
+			dependents[p] = append(dependents[p], i)
+		} else if !strings.HasPrefix(item.src, measurements) {
+			pending[i] = -1
+			reject(item, fmt.Errorf("missing source table"))
+		}
+	}
+
+	// Kahn's algorithm, the ready items are taken in rank order
+	var order []int
+	done := make([]bool, len(candidates))
+	for {
+		next := -1
+		for i := range candidates {
+			if !done[i] && pending[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			break
+		}
+		done[next] = true
+		order = append(order, next)
+		for _, d := range dependents[next] {
+			pending[d]--
+		}
+	}
+	for i, item := range candidates {
+		if !done[i] && pending[i] > 0 {
+			reject(item, fmt.Errorf("cycle or rejected source"))
+		}
+	}
+
+	var result []Item
+	accepted := make(map[string]int)
+	for _, i := range order {
+		item := candidates[i]
+		var src *Item
+		item.branch = i
+		if _, ok := producers[item.src]; ok {
+			idx, ok := accepted[item.src]
+			if !ok {
+				reject(item, fmt.Errorf("rejected source"))
+				continue
+			}
+			src = &result[idx]
+			item.branch = src.branch
+			if !alignedOn(item.bucket, src.bucket) {
+				reject(item, fmt.Errorf("period %s not aligned on the period %s of the source", item.bucket, src.bucket))
+				continue
+			}
+		}
+		if err := item.prepare(src); err != nil {
+			reject(item, err)
+			continue
+		}
+		accepted[item.dst] = len(result)
+		result = append(result, item)
+	}
+
+	// the items reading the same measurement table share their branch
+	branches := make(map[string]int)
+	for i := range result {
+		item := &result[i]
+		if _, ok := producers[item.src]; ok {
+			continue
+		}
+		if b, ok := branches[item.src]; ok {
+			merged := item.branch
+			for j := range result {
+				if result[j].branch == merged {
+					result[j].branch = b
+				}
+			}
+		} else {
+			branches[item.src] = item.branch
+		}
+	}
+	return result, errs
+}
@@ -0,0 +1,235 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func testRule(rank int64, src string, dst string, period int64, unit string, funcs ...string) Rule {
+	r := Rule{Rank: rank, Source: src, Dest: dst, Period: period, Unit: unit}
+	if unit != "" {
+		r.Timezone = "UTC"
+	}
+	for _, f := range funcs {
+		r.Aggregates = append(r.Aggregates, Aggregate{Func: f})
+	}
+	return r
+}
+
+func TestOrderItems(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []Rule
+		order    []string
+		rejected []string
+		branches [][]string
+	}{
+		{
+			name: "dependencies before rank",
+			rules: []Rule{
+				testRule(1, "hourly", "daily", 1, "day", "avg"),
+				testRule(2, "measurements_t", "hourly", 3600, "", "avg"),
+				testRule(3, "daily", "monthly", 1, "month", "avg"),
+			},
+			order:    []string{"hourly", "daily", "monthly"},
+			branches: [][]string{{"hourly", "daily", "monthly"}},
+		},
+		{
+			name: "independent branches",
+			rules: []Rule{
+				testRule(1, "measurements_t", "t_5min", 300, "", "avg"),
+				testRule(2, "measurements_h", "h_5min", 300, "", "avg"),
+				testRule(3, "measurements_t", "t_hourly", 3600, "", "max"),
+				testRule(4, "t_5min", "t_daily", 86400, "", "avg"),
+			},
+			order:    []string{"t_5min", "h_5min", "t_hourly", "t_daily"},
+			branches: [][]string{{"t_5min", "t_hourly", "t_daily"}, {"h_5min"}},
+		},
+		{
+			name: "cycle",
+			rules: []Rule{
+				testRule(1, "b", "a", 3600, "", "avg"),
+				testRule(2, "a", "b", 3600, "", "avg"),
+				testRule(3, "measurements_t", "c", 3600, "", "avg"),
+			},
+			order:    []string{"c"},
+			rejected: []string{"a", "b"},
+			branches: [][]string{{"c"}},
+		},
+		{
+			name: "missing source",
+			rules: []Rule{
+				testRule(1, "nowhere", "a", 3600, "", "avg"),
+				testRule(2, "a", "b", 3600, "", "avg"),
+			},
+			rejected: []string{"a", "b"},
+		},
+		{
+			name: "duplicate destination",
+			rules: []Rule{
+				testRule(1, "measurements_t", "a", 3600, "", "avg"),
+				testRule(2, "measurements_h", "a", 3600, "", "avg"),
+			},
+			order:    []string{"a"},
+			rejected: []string{"a"},
+			branches: [][]string{{"a"}},
+		},
+		{
+			name: "not aligned",
+			rules: []Rule{
+				testRule(1, "measurements_t", "a", 420, "", "avg"),
+				testRule(2, "a", "b", 3600, "", "avg"),
+				testRule(3, "a", "c", 2940, "", "avg"),
+			},
+			order:    []string{"a", "c"},
+			rejected: []string{"b"},
+			branches: [][]string{{"a", "c"}},
+		},
+		{
+			name: "rejected source",
+			rules: []Rule{
+				testRule(1, "measurements_t", "a", 3600, "", "nosuch"),
+				testRule(2, "a", "b", 86400, "", "avg"),
+			},
+			rejected: []string{"a", "b"},
+		},
+		{
+			name: "source rows needed",
+			rules: []Rule{
+				testRule(1, "measurements_t", "a", 3600, "", "median"),
+				testRule(2, "a", "b", 86400, "", "median"),
+				testRule(3, "a", "c", 86400, "", "p95"),
+			},
+			order:    []string{"a"},
+			rejected: []string{"b", "c"},
+			branches: [][]string{{"a"}},
+		},
+	}
+	for _, tt := range tests {
+		items, errs := validateRules(tt.rules)
+		var order []string
+		for _, item := range items {
+			order = append(order, item.dst)
+		}
+		if !slices.Equal(order, tt.order) {
+			t.Errorf("%s: order %v, want %v", tt.name, order, tt.order)
+		}
+		var rejected []string
+		for _, err := range errs {
+			dst, _, _ := strings.Cut(err.Error(), ":")
+			rejected = append(rejected, dst)
+		}
+		slices.Sort(rejected)
+		if !slices.Equal(rejected, tt.rejected) {
+			t.Errorf("%s: rejected %v, want %v (%v)", tt.name, rejected, tt.rejected, errs)
+		}
+		branches := make(map[int][]string)
+		var ids []int
+		for _, item := range items {
+			if _, ok := branches[item.branch]; !ok {
+				ids = append(ids, item.branch)
+			}
+			branches[item.branch] = append(branches[item.branch], item.dst)
+		}
+		var got [][]string
+		for _, id := range ids {
+			got = append(got, branches[id])
+		}
+		if !slices.EqualFunc(got, tt.branches, slices.Equal) {
+			t.Errorf("%s: branches %v, want %v", tt.name, got, tt.branches)
+		}
+	}
+}
+
+func TestPrepareTiered(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   []Aggregate
+		aggr  []Aggregate
+		funcs []string
+		cols  []string
+		err   bool
+	}{
+		{
+			name:  "raw source",
+			aggr:  []Aggregate{{Func: "avg"}, {Func: "last"}},
+			funcs: []string{"avg", "last", "lastts"},
+			cols:  []string{"value", "value", "value"},
+		},
+		{
+			name:  "merged functions",
+			src:   []Aggregate{{Func: "avg"}, {Func: "count"}, {Func: "first"}, {Func: "integralh"}},
+			aggr:  []Aggregate{{Func: "avg"}, {Func: "count"}, {Func: "first"}, {Func: "integralh"}},
+			funcs: []string{"wavg", "sum", "first", "sum", "firstts"},
+			cols:  []string{"vavg", "vcount", "vfirst", "vintegralh", "vfirst"},
+		},
+		{
+			name:  "other column",
+			src:   []Aggregate{{Func: "avg"}, {Func: "max", Column: "peak"}},
+			aggr:  []Aggregate{{Func: "max", Field: "peak"}, {Func: "min", Field: "vavg"}},
+			funcs: []string{"max", "min"},
+			cols:  []string{"peak", "vavg"},
+		},
+		{
+			name: "missing column",
+			src:  []Aggregate{{Func: "avg"}},
+			aggr: []Aggregate{{Func: "max"}},
+			err:  true,
+		},
+		{
+			name: "stddev of a consolidated table",
+			src:  []Aggregate{{Func: "stddev"}},
+			aggr: []Aggregate{{Func: "stddev"}},
+			err:  true,
+		},
+		{
+			name: "reserved column",
+			aggr: []Aggregate{{Func: "count", Column: "n"}},
+			err:  true,
+		},
+		{
+			name: "hidden column clash",
+			aggr: []Aggregate{{Func: "last"}, {Func: "max", Column: "vlast_ts"}},
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		var src *Item
+		if tt.src != nil {
+			src = &Item{dst: "src", aggr: tt.src}
+			if err := src.prepare(nil); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		item := Item{dst: "dst", aggr: tt.aggr}
+		err := item.prepare(src)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: prepare error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !slices.Equal(item.funcs, tt.funcs) || !slices.Equal(item.cols, tt.cols) {
+			t.Errorf("%s: funcs %v cols %v, want %v %v", tt.name, item.funcs, item.cols, tt.funcs, tt.cols)
+		}
+	}
+}
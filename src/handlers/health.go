@@ -0,0 +1,86 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A readiness check tells whether a part of the pipeline works, maxAge
+// is the threshold for the activities expected to happen regularly
+type readyCheck struct {
+	name  string
+	check func(ctx context.Context, maxAge time.Duration) (bool, map[string]any)
+}
+
+var (
+	readyMu           sync.Mutex
+	readyChecks       []readyCheck
+	lastInsert        atomic.Int64
+	lastConsolidation atomic.Int64
+)
+
+func onReady(name string, check func(ctx context.Context, maxAge time.Duration) (bool, map[string]any)) {
+	readyMu.Lock()
+	readyChecks = append(readyChecks, readyCheck{name, check})
+	readyMu.Unlock()
+}
+
+// activityCheck is ready when the activity happened less than maxAge ago
+func activityCheck(last *atomic.Int64) func(context.Context, time.Duration) (bool, map[string]any) {
+	return func(ctx context.Context, maxAge time.Duration) (bool, map[string]any) {
+		t := time.Unix(0, last.Load())
+		age := time.Since(t)
+		return age <= maxAge, map[string]any{"last": t, "age": age.Round(time.Second).String(), "max_age": maxAge.String()}
+	}
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "alive"})
+}
+
+func readyzHandler(maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		readyMu.Lock()
+		checks := slices.Clone(readyChecks)
+		readyMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+
+		ready := true
+		details := make(map[string]any)
+		for _, c := range checks {
+			ok, detail := c.check(ctx, maxAge)
+			detail["ok"] = ok
+			details[c.name] = detail
+			ready = ready && ok
+		}
+
+		if ready {
+			writeJSON(w, http.StatusOK, map[string]any{"status": "ready", "checks": details})
+		} else {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not ready", "checks": details})
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActivityCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		ago  time.Duration
+		want bool
+	}{
+		{"recent", time.Minute, true},
+		{"stale", time.Hour, false},
+		{"never", -1, false},
+	}
+	for _, tt := range tests {
+		var last atomic.Int64
+		if tt.ago >= 0 {
+			last.Store(time.Now().Add(-tt.ago).UnixNano())
+		}
+		ok, detail := activityCheck(&last)(context.Background(), 10*time.Minute)
+		if ok != tt.want {
+			t.Errorf("%s: ready %v, want %v (%v)", tt.name, ok, tt.want, detail)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	saved := readyChecks
+	defer func() { readyChecks = saved }()
+
+	check := func(ok bool) func(context.Context, time.Duration) (bool, map[string]any) {
+		return func(context.Context, time.Duration) (bool, map[string]any) {
+			return ok, map[string]any{}
+		}
+	}
+	tests := []struct {
+		name   string
+		checks []bool
+		code   int
+		status string
+	}{
+		{"no check", nil, http.StatusOK, "ready"},
+		{"all ready", []bool{true, true}, http.StatusOK, "ready"},
+		{"one failing", []bool{true, false}, http.StatusServiceUnavailable, "not ready"},
+	}
+	for _, tt := range tests {
+		readyChecks = nil
+		for i, ok := range tt.checks {
+			onReady(string(rune('a'+i)), check(ok))
+		}
+		rec := httptest.NewRecorder()
+		readyzHandler(time.Minute)(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var body struct {
+			Status string
+			Checks map[string]map[string]any
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if rec.Code != tt.code || body.Status != tt.status || len(body.Checks) != len(tt.checks) {
+			t.Errorf("%s: %d %q with %d checks, want %d %q with %d", tt.name, rec.Code, body.Status, len(body.Checks), tt.code, tt.status, len(tt.checks))
+		}
+		for i, ok := range tt.checks {
+			if got := body.Checks[string(rune('a'+i))]["ok"]; got != ok {
+				t.Errorf("%s: check %d ok %v, want %v", tt.name, i, got, ok)
+			}
+		}
+	}
+}
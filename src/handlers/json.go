@@ -18,29 +18,77 @@
 package handlers
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 )
 
-func JSONHandler(ich <-chan string) chan Datapoint {
+// JSONHandler decodes the messages, arrays of datapoints or single
+// datapoints, into datapoints. Sparkplug B topics
+// are handed over to the Sparkplug decoder and the topics matched by a
+// mapping rule are reshaped by this rule
+func JSONHandler(ich <-chan Message) chan Datapoint {
 
-	c := make(chan Datapoint, 10)
+	q := newQueue[Datapoint]("json")
 
 	go func() {
-		defer close(c)
+		defer q.close()
+		sp := newSparkplugDecoder()
 		for msg := range ich {
+			if isSparkplugTopic(msg.Topic) {
+				dps := sp.Decode(msg.Topic, msg.Payload, msg.Received)
+				countDatapoints("sparkplug", dps)
+				for _, dp := range dps {
+					q.push(dp)
+				}
+				continue
+			}
+			if rule := mapping.Load().match(msg.Topic); rule != nil && msg.Topic != "" {
+				slog.Debug("Mapping", "topic", msg.Topic, "rule", rule.Topic, "msg", string(msg.Payload))
+				dps, err := rule.decode(msg.Topic, msg.Payload, receivedMilli(msg.Received))
+				if err != nil {
+					slog.Error("Mapping", "topic", msg.Topic, "error", err)
+					rejectedMessages.inc("mapping")
+				}
+				countDatapoints("mapping", dps)
+				for _, dp := range dps {
+					q.push(dp)
+				}
+				continue
+			}
 			var dps []Datapoint
-			slog.Debug("String received", "msg", msg)
-			err := json.Unmarshal([]byte(msg), &dps)
+			slog.Debug("String received", "msg", string(msg.Payload))
+			var err error
+			if payload := bytes.TrimSpace(msg.Payload); len(payload) > 0 && payload[0] == '{' {
+				dps = make([]Datapoint, 1)
+				err = json.Unmarshal(payload, &dps[0])
+			} else {
+				err = json.Unmarshal(payload, &dps)
+			}
 			if err != nil {
 				slog.Error("Unmarshal", "error", err)
+				rejectedMessages.inc("json")
 			} else {
+				countDatapoints("json", dps)
 				for _, dp := range dps {
-					c <- dp
+					q.push(dp)
 				}
 			}
 		}
 	}()
 
-	return c
+	return q.c
+}
+
+// countDatapoints counts the decoded datapoints by measurement table, the
+// topics are too many to label the metrics with
+func countDatapoints(decoder string, dps []Datapoint) {
+	for _, dp := range dps {
+		table := statusTable
+		if dp.Measurement != statusMeasurement {
+			table = fmt.Sprintf(measurementTmpl, dp.Measurement)
+		}
+		parsedDatapoints.inc(decoder, table)
+	}
 }
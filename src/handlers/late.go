@@ -0,0 +1,185 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A datapoint is late when its bucket is already consolidated from its
+// measurement table. It is always inserted, within the tolerance its
+// bucket is consolidated again at the next wake of the consolidator,
+// beyond it the consolidated data is left as is. With no tolerance the
+// late datapoints are only counted
+var (
+	lateMu        sync.Mutex
+	consolidated  = map[string]int64{}    // source table: end of the consolidated data
+	lateRanges    = map[string][2]int64{} // source table: oldest and newest late ts
+	lateTolerance atomic.Int64
+)
+
+func init() {
+	lateTolerance.Store(int64(24 * time.Hour))
+}
+
+// SetLateTolerance changes how old a late datapoint may be to be
+// consolidated again, 0 to keep the late datapoints out of the
+// consolidated tables
+func SetLateTolerance(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("bad late tolerance %s", d)
+	}
+	lateTolerance.Store(int64(d))
+	return nil
+}
+
+// setConsolidated records the end of the data consolidated from a table,
+// it returns the previous one
+func setConsolidated(table string, t int64) int64 {
+	lateMu.Lock()
+	defer lateMu.Unlock()
+	prev := consolidated[table]
+	consolidated[table] = max(prev, t)
+	return prev
+}
+
+// resetConsolidated moves the end of the data consolidated from a table
+// back to prev when the consolidation up to t failed
+func resetConsolidated(table string, prev int64, t int64) {
+	lateMu.Lock()
+	if consolidated[table] == t {
+		consolidated[table] = prev
+	}
+	lateMu.Unlock()
+}
+
+// checkLate records the late datapoint of the table at ts, in seconds,
+// whose bucket is to be consolidated again
+func checkLate(table string, ts int64) {
+	lateMu.Lock()
+	defer lateMu.Unlock()
+
+	if ts >= consolidated[table] {
+		return
+	}
+	tolerance := time.Duration(lateTolerance.Load())
+	switch {
+	case tolerance == 0:
+		lateDatapoints.inc(table, "ignored")
+		return
+	case time.Since(time.Unix(ts, 0)) > tolerance:
+		lateDatapoints.inc(table, "expired")
+		slog.Debug("Late datapoint not consolidated again", "table", table, "ts", ts, "tolerance", tolerance.String())
+		return
+	}
+	lateDatapoints.inc(table, "reconsolidated")
+	if r, ok := lateRanges[table]; ok {
+		lateRanges[table] = [2]int64{min(r[0], ts), max(r[1], ts)}
+	} else {
+		lateRanges[table] = [2]int64{ts, ts}
+	}
+}
+
+func takeLateRanges() map[string][2]int64 {
+	lateMu.Lock()
+	defer lateMu.Unlock()
+	ranges := lateRanges
+	lateRanges = map[string][2]int64{}
+	return ranges
+}
+
+// ConsolidateLate consolidates again the buckets touched by the late
+// datapoints, in rank order so that the dependent items follow
+func (db *DB) ConsolidateLate(ctx context.Context, items []Item) bool {
+	ranges := takeLateRanges()
+	if len(ranges) == 0 {
+		return true
+	}
+	ok := true
+	for _, item := range items {
+		r, found := ranges[item.src]
+		end, known := browsed(item.dst)
+		if !found || !known || len(item.names) == 0 || r[0] >= end {
+			continue
+		}
+		t1 := item.bucket.floor(r[0])
+		t2 := item.bucket.next(r[1])
+		// the next bucket starts from the last point of this one
+		if item.carries() {
+			t2 = item.bucket.next(t2)
+		}
+		t2 = min(t2, end)
+		slog.Info("Late data", "src_table", item.src, "dst_table", item.dst, "t1", t1, "t2", t2)
+		if !db.ReconsolidateItem(ctx, item, t1, t2) {
+			consolidationErrs.inc(item.dst)
+			ok = false
+			continue
+		}
+		// the dependent items consolidate these buckets again
+		if d, found := ranges[item.dst]; found {
+			ranges[item.dst] = [2]int64{min(d[0], t1), max(d[1], t2-1)}
+		} else {
+			ranges[item.dst] = [2]int64{t1, t2 - 1}
+		}
+	}
+	return ok
+}
+
+// ReconsolidateItem consolidates [t1, t2) again, the buckets are derived
+// again from the source or, when the source data is deleted by the
+// consolidation, the late rows are merged into them and deleted. The
+// buckets whose functions can't be merged, median, percentiles and
+// integrals, are left as is, with the late rows in the source. So are
+// the buckets whose source data is deleted after the commit: the rows of
+// a delete left undone would be merged twice
+func (db *DB) ReconsolidateItem(ctx context.Context, item Item, t1 int64, t2 int64) bool {
+	if item.src_delete == "yes" && !item.mergeable() {
+		slog.Warn("Late data not merged", "dst_table", item.dst, "funcs", strings.Join(item.funcs, ", "), "t1", t1, "t2", t2)
+		return true
+	}
+	if item.src_delete == "yes" && getDeletePolicy().deferred {
+		slog.Warn("Late data not merged, source data deleted after the commit", "dst_table", item.dst, "t1", t1, "t2", t2)
+		return true
+	}
+	tx, ok := db.BeginTransaction(ctx)
+	if !ok {
+		return false
+	}
+	var inserted int64
+	if item.src_delete == "yes" {
+		inserted, ok = tx.insertConsolidatedData(item, t1, t2)
+		ok = ok && tx.DeleteData(item.src, t1, t2, item.filter)
+	} else if ok = tx.DeleteData(item.dst, t1, t2, nil); ok {
+		inserted, ok = tx.insertConsolidatedData(item, t1, t2)
+	}
+	if !ok {
+		tx.RollbackTransaction()
+		return false
+	}
+	if !tx.CommitTransaction() {
+		return false
+	}
+	consolidatedRows.add(float64(inserted), item.dst)
+	return true
+}
@@ -0,0 +1,150 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLate(t *testing.T) {
+	defer SetLateTolerance(24 * time.Hour)
+
+	now := time.Now().Unix()
+	hour := int64(3600)
+	tests := []struct {
+		name      string
+		tolerance time.Duration
+		ts        []int64
+		want      map[string][2]int64
+	}{
+		{"on time", time.Hour, []int64{now - hour, now}, map[string][2]int64{}},
+		{"late", 2 * time.Hour, []int64{now - 90*60, now - 2*hour + 60, now - 3*hour/2 - 60}, map[string][2]int64{
+			"t": {now - 2*hour + 60, now - 90*60},
+		}},
+		{"expired", time.Hour, []int64{now - 90*60, now - 3*hour}, map[string][2]int64{}},
+		{"only counted", 0, []int64{now - 90*60}, map[string][2]int64{}},
+	}
+	for _, tt := range tests {
+		SetLateTolerance(tt.tolerance)
+		takeLateRanges()
+		setConsolidated("t", now-hour)
+		for _, ts := range tt.ts {
+			checkLate("t", ts)
+		}
+		if got := takeLateRanges(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: late ranges %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResetConsolidated(t *testing.T) {
+	tests := []struct {
+		name   string
+		before int64
+		other  int64
+		want   int64
+	}{
+		{"rolled back", 100, 0, 100},
+		{"advanced by another item", 100, 400, 400},
+		{"first consolidation", 0, 0, 0},
+	}
+	for i, tt := range tests {
+		table := string(rune('a' + i))
+		setConsolidated(table, tt.before)
+		prev := setConsolidated(table, 300)
+		setConsolidated(table, tt.other)
+		resetConsolidated(table, prev, 300)
+		lateMu.Lock()
+		got := consolidated[table]
+		lateMu.Unlock()
+		if got != tt.want {
+			t.Errorf("%s: consolidated %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInsertMeasurementLate(t *testing.T) {
+	defer SetLateTolerance(24 * time.Hour)
+	SetLateTolerance(2 * time.Hour)
+	measReceived = make(map[string]int64)
+
+	now := time.Now().Unix()
+	tests := []struct {
+		name string
+		err  error
+		want map[string][2]int64
+	}{
+		{"inserted", nil, map[string][2]int64{"measurements_lt": {now - 5400, now - 5400}}},
+		{"not inserted", errors.New("lost"), map[string][2]int64{}},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		f.on(`^INSERT INTO measurements_lt\b`, fakeReply{affected: 1, err: tt.err})
+		takeLateRanges()
+		setConsolidated("measurements_lt", now-3600)
+		dp := Datapoint{Measurement: "lt", Timestamp: (now - 5400) * 1000}
+		db.InsertMeasurement(&dp)
+		if got := takeLateRanges(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: late ranges %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReconsolidateItem(t *testing.T) {
+	defer SetDeletePolicy("10000", 0, false)
+
+	tests := []struct {
+		name     string
+		delete   bool
+		fn       string
+		deferred bool
+		want     []string
+	}{
+		{"derived again", false, "avg", false, []string{"BEGIN", "DELETE FROM t_late", "INSERT INTO t_late", "COMMIT"}},
+		{"merged", true, "avg", false, []string{"BEGIN", "INSERT INTO t_late", "DELETE FROM measurements_t", "COMMIT"}},
+		{"not mergeable", true, "median", false, nil},
+		{"deleted after commit", true, "avg", true, nil},
+		{"derived again, deleted after commit", false, "avg", true, []string{"BEGIN", "DELETE FROM t_late", "INSERT INTO t_late", "COMMIT"}},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		SetDeletePolicy("0", 0, tt.deferred)
+		r := testRule(1, "measurements_t", "t_late", 3600, "", tt.fn)
+		r.SrcDelete = tt.delete
+		items, errs := validateRules([]Rule{r})
+		if len(errs) > 0 {
+			t.Fatal(errs)
+		}
+		item := items[0]
+		if !db.ReconsolidateItem(t.Context(), item, 0, 3600) {
+			t.Errorf("%s: not reconsolidated", tt.name)
+		}
+		var got []string
+		for _, c := range f.executed(``) {
+			got = append(got, strings.Join(strings.Fields(c.query)[:min(3, len(strings.Fields(c.query)))], " "))
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: statements %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A mapping file reshapes arbitrary JSON payloads into datapoints:
+//
+//	{"rules": [{
+//		"topic": "zigbee2mqtt/+",
+//		"tags": {"id": "{topic[1]}", "place": "$.location"},
+//		"values": [{"measurement": "{key}", "value": "$.*"}],
+//		"tests": [{"topic": "zigbee2mqtt/th1", "payload": {...}, "expect": [...]}]
+//	}]}
+//
+// Expressions starting with '$' are JSONPath-like paths evaluated on
+// the payload ($.a.b, $.a[0], $['a b'], $.*, $.a[*]), anything else
+// is a template where {topic[N]} is the Nth level of the topic and
+// {key} the last key of the matched value.
+
+type mappingValue struct {
+	Measurement string             `json:"measurement"`
+	Value       string             `json:"value"`
+	Map         map[string]float64 `json:"map,omitempty"`
+
+	measurement expression
+	value       jsonPath
+}
+
+type mappingTest struct {
+	Topic   string          `json:"topic"`
+	Payload json.RawMessage `json:"payload"`
+	Expect  []Datapoint     `json:"expect"`
+}
+
+type mappingRule struct {
+	Topic           string `json:"topic"`
+	Timestamp       string `json:"timestamp,omitempty"`
+	TimestampFormat string `json:"timestamp_format,omitempty"`
+	Tags            struct {
+		ID    string `json:"id"`
+		Name  string `json:"name"`
+		Place string `json:"place"`
+	} `json:"tags"`
+	Values []mappingValue `json:"values"`
+	Tests  []mappingTest  `json:"tests,omitempty"`
+
+	timestamp expression
+	id        expression
+	name      expression
+	place     expression
+}
+
+type mappingRules struct {
+	Rules []mappingRule `json:"rules"`
+}
+
+type pathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+type jsonPath []pathStep
+
+type pathMatch struct {
+	key   string
+	value any
+}
+
+type expression struct {
+	path   jsonPath
+	tmpl   string
+	isPath bool
+}
+
+var (
+	mapping      atomic.Pointer[mappingRules] // swapped by the reloads
+	templateVars = regexp.MustCompile(`\{(topic\[(\d+)\]|key)\}`)
+)
+
+// LoadMapping reads and compiles the mapping rules, the rules are used
+// by JSONHandler for the topics they match
+func LoadMapping(filename string) error {
+	rules, err := readMapping(filename)
+	if err != nil {
+		return err
+	}
+	mapping.Store(rules)
+	slog.Info("Mapping loaded", "filename", filename, "rules", len(rules.Rules))
+	return nil
+}
+
+// CheckMapping reads and compiles the mapping rules without using them
+func CheckMapping(filename string) error {
+	_, err := readMapping(filename)
+	return err
+}
+
+// TestMapping runs the tests embedded in the mapping rules and reports
+// the results on stdout
+func TestMapping(filename string) bool {
+	rules, err := readMapping(filename)
+	if err != nil {
+		fmt.Printf("FAIL %s: %v\n", filename, err)
+		return false
+	}
+
+	ok := true
+	count := 0
+	for i := range rules.Rules {
+		rule := &rules.Rules[i]
+		for j, test := range rule.Tests {
+			count++
+			label := fmt.Sprintf("rule %d (%s) test %d", i+1, rule.Topic, j+1)
+			matched := rules.match(test.Topic)
+			if matched != rule {
+				fmt.Printf("FAIL %s: topic %s not handled by this rule\n", label, test.Topic)
+				ok = false
+				continue
+			}
+			got, err := rule.decode(test.Topic, test.Payload, 0)
+			if err != nil {
+				fmt.Printf("FAIL %s: %v\n", label, err)
+				ok = false
+				continue
+			}
+			for k := range got {
+				if k < len(test.Expect) && test.Expect[k].Timestamp == 0 {
+					got[k].Timestamp = 0
+				}
+			}
+			if len(got) == 0 && len(test.Expect) == 0 || reflect.DeepEqual(got, test.Expect) {
+				fmt.Printf("PASS %s\n", label)
+				continue
+			}
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(test.Expect)
+			fmt.Printf("FAIL %s:\n  got  %s\n  want %s\n", label, gotJSON, wantJSON)
+			ok = false
+		}
+	}
+	fmt.Printf("%d tests, %d rules\n", count, len(rules.Rules))
+
+	return ok
+}
+
+func readMapping(filename string) (*mappingRules, error) {
+	buff, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules := &mappingRules{}
+	if err := json.Unmarshal(buff, rules); err != nil {
+		return nil, err
+	}
+	for i := range rules.Rules {
+		if err := rules.Rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("rule %d (%s): %w", i+1, rules.Rules[i].Topic, err)
+		}
+	}
+	return rules, nil
+}
+
+func (rules *mappingRules) match(topic string) *mappingRule {
+	if rules == nil {
+		return nil
+	}
+	for i := range rules.Rules {
+		if topicMatch(rules.Rules[i].Topic, topic) {
+			return &rules.Rules[i]
+		}
+	}
+	return nil
+}
+
+func (r *mappingRule) compile() error {
+	var err error
+	if r.Topic == "" {
+		return fmt.Errorf("missing topic")
+	}
+	if len(r.Values) == 0 {
+		return fmt.Errorf("no values")
+	}
+	if r.timestamp, err = parseExpression(r.Timestamp); err != nil {
+		return fmt.Errorf("timestamp: %w", err)
+	}
+	if r.id, err = parseExpression(r.Tags.ID); err != nil {
+		return fmt.Errorf("tags.id: %w", err)
+	}
+	if r.name, err = parseExpression(r.Tags.Name); err != nil {
+		return fmt.Errorf("tags.name: %w", err)
+	}
+	if r.place, err = parseExpression(r.Tags.Place); err != nil {
+		return fmt.Errorf("tags.place: %w", err)
+	}
+	for i := range r.Values {
+		v := &r.Values[i]
+		if v.measurement, err = parseExpression(v.Measurement); err != nil {
+			return fmt.Errorf("values[%d].measurement: %w", i, err)
+		}
+		if v.Measurement == "" {
+			return fmt.Errorf("values[%d]: missing measurement", i)
+		}
+		if !strings.HasPrefix(v.Value, "$") {
+			return fmt.Errorf("values[%d]: value must be a path", i)
+		}
+		if v.value, err = parsePath(v.Value); err != nil {
+			return fmt.Errorf("values[%d].value: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// decode applies the rule on a payload, now is used when the payload
+// carries no timestamp
+func (r *mappingRule) decode(topic string, payload []byte, now int64) ([]Datapoint, error) {
+	var doc any
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return nil, err
+	}
+	levels := strings.Split(topic, "/")
+
+	ts := now
+	if r.Timestamp != "" {
+		if t, ok := parseTimestamp(r.timestamp.eval(doc, levels, ""), r.TimestampFormat); ok {
+			ts = t
+		} else {
+			slog.Debug("Mapping timestamp not found", "topic", topic, "timestamp", r.Timestamp)
+		}
+	}
+
+	var result []Datapoint
+	for _, v := range r.Values {
+		for _, m := range v.value.eval(doc) {
+			value, ok := v.float(m.value)
+			if !ok {
+				slog.Debug("Mapping value ignored", "topic", topic, "key", m.key, "value", m.value)
+				continue
+			}
+			dp := Datapoint{Measurement: measurementName(stringOf(v.measurement.eval(doc, levels, m.key)))}
+			if dp.Measurement == "" {
+				continue
+			}
+			dp.Fields.Value = value
+			dp.Tags.ID = stringOf(r.id.eval(doc, levels, m.key))
+			dp.Tags.Name = stringOf(r.name.eval(doc, levels, m.key))
+			dp.Tags.Place = stringOf(r.place.eval(doc, levels, m.key))
+			dp.Timestamp = ts
+			result = append(result, dp)
+		}
+	}
+	return result, nil
+}
+
+func (v *mappingValue) float(value any) (float64, bool) {
+	switch x := value.(type) {
+	case float64:
+		return x, true
+	case bool:
+		if x {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		if f, ok := v.Map[x]; ok {
+			return f, true
+		}
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// parseTimestamp accepts epoch seconds or milliseconds, RFC 3339 and
+// local times as published by Tasmota, or the given layout if any
+func parseTimestamp(value any, layout string) (int64, bool) {
+	switch x := value.(type) {
+	case float64:
+		if x < 1e11 {
+			return int64(x * 1000), true
+		}
+		return int64(x), true
+	case string:
+		layouts := []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+		if layout != "" {
+			layouts = []string{layout}
+		}
+		for _, layout := range layouts {
+			if t, err := time.ParseInLocation(layout, x, time.Local); err == nil {
+				return t.UnixMilli(), true
+			}
+		}
+		if f, err := strconv.ParseFloat(x, 64); err == nil {
+			return parseTimestamp(f, layout)
+		}
+	}
+	return 0, false
+}
+
+func parseExpression(s string) (expression, error) {
+	if strings.HasPrefix(s, "$") {
+		path, err := parsePath(s)
+		return expression{path: path, isPath: true}, err
+	}
+	return expression{tmpl: s}, nil
+}
+
+func (e expression) eval(doc any, levels []string, key string) any {
+	if e.isPath {
+		if matches := e.path.eval(doc); len(matches) > 0 {
+			return matches[0].value
+		}
+		return nil
+	}
+	return templateVars.ReplaceAllStringFunc(e.tmpl, func(v string) string {
+		sub := templateVars.FindStringSubmatch(v)
+		if sub[1] == "key" {
+			return key
+		}
+		n, _ := strconv.Atoi(sub[2])
+		if n < len(levels) {
+			return levels[n]
+		}
+		return ""
+	})
+}
+
+func stringOf(value any) string {
+	switch x := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// parsePath compiles the subset of JSONPath used by the mapping rules
+func parsePath(s string) (jsonPath, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("path %q must start with '$'", s)
+	}
+	var path jsonPath
+	rest := s[1:]
+	for len(rest) > 0 {
+		switch {
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path %q: missing ']'", s)
+			}
+			sel := rest[1:end]
+			rest = rest[end+1:]
+			switch {
+			case sel == "*":
+				path = append(path, pathStep{wildcard: true})
+			case len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0]:
+				path = append(path, pathStep{key: sel[1 : len(sel)-1]})
+			default:
+				n, err := strconv.Atoi(sel)
+				if err != nil {
+					return nil, fmt.Errorf("path %q: bad index %q", s, sel)
+				}
+				path = append(path, pathStep{index: n, isIndex: true})
+			}
+		case strings.HasPrefix(rest, "."):
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			rest = rest[end:]
+			switch key {
+			case "":
+				return nil, fmt.Errorf("path %q: empty key", s)
+			case "*":
+				path = append(path, pathStep{wildcard: true})
+			default:
+				path = append(path, pathStep{key: key})
+			}
+		default:
+			return nil, fmt.Errorf("path %q: unexpected %q", s, rest)
+		}
+	}
+	return path, nil
+}
+
+// eval returns the values selected by the path, in document order for
+// arrays and in key order for objects
+func (path jsonPath) eval(doc any) []pathMatch {
+	matches := []pathMatch{{value: doc}}
+	for _, step := range path {
+		var next []pathMatch
+		for _, m := range matches {
+			switch x := m.value.(type) {
+			case map[string]any:
+				if step.wildcard {
+					keys := make([]string, 0, len(x))
+					for k := range x {
+						keys = append(keys, k)
+					}
+					slices.Sort(keys)
+					for _, k := range keys {
+						next = append(next, pathMatch{key: k, value: x[k]})
+					}
+				} else if v, ok := x[step.key]; ok && !step.isIndex {
+					next = append(next, pathMatch{key: step.key, value: v})
+				}
+			case []any:
+				if step.wildcard {
+					for i, v := range x {
+						next = append(next, pathMatch{key: strconv.Itoa(i), value: v})
+					}
+				} else if step.isIndex && step.index >= 0 && step.index < len(x) {
+					next = append(next, pathMatch{key: strconv.Itoa(step.index), value: x[step.index]})
+				}
+			}
+		}
+		matches = next
+	}
+	return matches
+}
+
+// topicMatch applies the MQTT wildcards '+' and '#'
+func topicMatch(pattern string, topic string) bool {
+	p := strings.Split(pattern, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range p {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) || (level != "+" && level != t[i]) {
+			return false
+		}
+	}
+	return len(p) == len(t)
+}
@@ -0,0 +1,268 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want jsonPath
+		err  bool
+	}{
+		{"$", nil, false},
+		{"$.a.b", jsonPath{{key: "a"}, {key: "b"}}, false},
+		{"$.a[0]", jsonPath{{key: "a"}, {index: 0, isIndex: true}}, false},
+		{"$['a b'][\"c\"]", jsonPath{{key: "a b"}, {key: "c"}}, false},
+		{"$.*", jsonPath{{wildcard: true}}, false},
+		{"$.a[*].v", jsonPath{{key: "a"}, {wildcard: true}, {key: "v"}}, false},
+		{"a.b", nil, true},
+		{"$.", nil, true},
+		{"$..a", nil, true},
+		{"$[0", nil, true},
+		{"$[x]", nil, true},
+		{"$a", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parsePath(tt.path)
+		if (err != nil) != tt.err {
+			t.Errorf("parsePath(%q) error %v, want error %v", tt.path, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePath(%q) = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathEval(t *testing.T) {
+	var doc any
+	payload := `{"b": 2, "a": {"x": 1.5, "y": "on"}, "list": [{"v": 10}, {"v": 20}, {"w": 30}], "a b": true}`
+	if err := json.Unmarshal([]byte(payload), &doc); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []pathMatch
+	}{
+		{"$.b", []pathMatch{{"b", 2.0}}},
+		{"$.a.x", []pathMatch{{"x", 1.5}}},
+		{"$['a b']", []pathMatch{{"a b", true}}},
+		{"$.a.*", []pathMatch{{"x", 1.5}, {"y", "on"}}},
+		{"$.list[1].v", []pathMatch{{"v", 20.0}}},
+		{"$.list[*].v", []pathMatch{{"v", 10.0}, {"v", 20.0}}},
+		{"$.list.*.w", []pathMatch{{"w", 30.0}}},
+		{"$.list[3]", nil},
+		{"$.list[-1]", nil},
+		{"$.a[0]", nil},
+		{"$.missing", nil},
+		{"$.b.c", nil},
+	}
+	for _, tt := range tests {
+		path, err := parsePath(tt.path)
+		if err != nil {
+			t.Errorf("parsePath(%q): %v", tt.path, err)
+			continue
+		}
+		if got := path.eval(doc); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("eval(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, tt := range tests {
+		if got := topicMatch(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	local := time.Date(2025, 10, 18, 12, 30, 0, 0, time.Local).UnixMilli()
+	tests := []struct {
+		value  any
+		layout string
+		want   int64
+		ok     bool
+	}{
+		{1760790600.0, "", 1760790600000, true},
+		{1760790600123.0, "", 1760790600123, true},
+		{"1760790600", "", 1760790600000, true},
+		{"2025-10-18T12:30:00Z", "", 1760790600000, true},
+		{"2025-10-18T12:30:00.250+02:00", "", 1760783400250, true},
+		{"2025-10-18T12:30:00", "", local, true},
+		{"2025-10-18 12:30:00", "", local, true},
+		{"18/10/2025 12:30", "02/01/2006 15:04", local, true},
+		{"2025-10-18T12:30:00", "02/01/2006 15:04", 0, false},
+		{"soon", "", 0, false},
+		{nil, "", 0, false},
+		{true, "", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimestamp(tt.value, tt.layout)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseTimestamp(%v, %q) = %d, %v, want %d, %v", tt.value, tt.layout, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMappingCompile(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		err  bool
+	}{
+		{"valid", `{"topic": "a/+", "tags": {"id": "{topic[1]}"}, "values": [{"measurement": "{key}", "value": "$.*"}]}`, false},
+		{"no topic", `{"values": [{"measurement": "t", "value": "$.t"}]}`, true},
+		{"no values", `{"topic": "a"}`, true},
+		{"no measurement", `{"topic": "a", "values": [{"value": "$.t"}]}`, true},
+		{"value template", `{"topic": "a", "values": [{"measurement": "t", "value": "t"}]}`, true},
+		{"bad value path", `{"topic": "a", "values": [{"measurement": "t", "value": "$["}]}`, true},
+		{"bad tag path", `{"topic": "a", "tags": {"place": "$."}, "values": [{"measurement": "t", "value": "$.t"}]}`, true},
+		{"bad timestamp path", `{"topic": "a", "timestamp": "$x", "values": [{"measurement": "t", "value": "$.t"}]}`, true},
+	}
+	for _, tt := range tests {
+		var r mappingRule
+		if err := json.Unmarshal([]byte(tt.rule), &r); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := r.compile(); (err != nil) != tt.err {
+			t.Errorf("%s: compile() error %v, want error %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestMappingDecode(t *testing.T) {
+	rule := `{
+		"topic": "zigbee2mqtt/+",
+		"timestamp": "$.time",
+		"tags": {"id": "{topic[1]}", "name": "{topic[1]} {key}", "place": "$.location"},
+		"values": [
+			{"measurement": "{key}", "value": "$.sensors.*"},
+			{"measurement": "state", "value": "$.state", "map": {"ON": 1, "OFF": 0}}
+		]
+	}`
+	var r mappingRule
+	if err := json.Unmarshal([]byte(rule), &r); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+	type point struct {
+		measurement string
+		value       float64
+		id          string
+		name        string
+		place       string
+		ts          int64
+	}
+	tests := []struct {
+		name    string
+		payload string
+		want    []point
+		err     bool
+	}{
+		{"values", `{"time": 1760790600, "location": "garage", "sensors": {"Temperature": 21.5, "humidity": "55", "label": "x"}, "state": "ON"}`, []point{
+			{"temperature", 21.5, "th1", "th1 Temperature", "garage", 1760790600000},
+			{"humidity", 55, "th1", "th1 humidity", "garage", 1760790600000},
+			{"state", 1, "th1", "th1 state", "garage", 1760790600000},
+		}, false},
+		{"no timestamp", `{"sensors": {"t": true}, "state": "OFF"}`, []point{
+			{"t", 1, "th1", "th1 t", "", 42},
+			{"state", 0, "th1", "th1 state", "", 42},
+		}, false},
+		{"nothing matched", `{"other": 1}`, nil, false},
+		{"not json", `{`, nil, true},
+	}
+	for _, tt := range tests {
+		dps, err := r.decode("zigbee2mqtt/th1", []byte(tt.payload), 42)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: decode error %v, want error %v", tt.name, err, tt.err)
+			continue
+		}
+		var got []point
+		for _, dp := range dps {
+			got = append(got, point{dp.Measurement, dp.Fields.Value, dp.Tags.ID, dp.Tags.Name, dp.Tags.Place, dp.Timestamp})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadMapping(t *testing.T) {
+	defer mapping.Store(nil)
+
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	first := write("first.json", `{"rules": [{"topic": "a/#", "values": [{"measurement": "t", "value": "$.t"}]}]}`)
+	second := write("second.json", `{"rules": [{"topic": "b/+", "values": [{"measurement": "t", "value": "$.t"}]}]}`)
+	broken := write("broken.json", `{"rules": [{"topic": "c", "values": []}]}`)
+
+	tests := []struct {
+		filename string
+		err      bool
+		topic    string
+		matched  bool
+	}{
+		{first, false, "a/x/y", true},
+		{second, false, "a/x/y", false},
+		{second, false, "b/x", true},
+		// a failed reload keeps the rules in use
+		{broken, true, "b/x", true},
+		{filepath.Join(dir, "missing.json"), true, "b/x", true},
+	}
+	for _, tt := range tests {
+		if err := LoadMapping(tt.filename); (err != nil) != tt.err {
+			t.Errorf("LoadMapping(%s) error %v, want error %v", filepath.Base(tt.filename), err, tt.err)
+		}
+		if got := mapping.Load().match(tt.topic) != nil; got != tt.matched {
+			t.Errorf("after %s: match(%q) = %v, want %v", filepath.Base(tt.filename), tt.topic, got, tt.matched)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics are exposed in the Prometheus text format, gauges which
+// reflect a state are refreshed by the scrape hooks
+const (
+	kindCounter = "counter"
+	kindGauge   = "gauge"
+	kindSummary = "summary"
+)
+
+type sample struct {
+	labels []string
+	value  float64
+	count  uint64
+}
+
+type metric struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+var (
+	metricsMu   sync.Mutex
+	metrics     []*metric
+	scrapeHooks []func()
+
+	mqttReceived      = newMetric("mqtt2sql_mqtt_messages_received_total", kindCounter, "MQTT messages received")
+	mqttConnected     = newMetric("mqtt2sql_mqtt_connected", kindGauge, "MQTT connection state")
+	parsedDatapoints  = newMetric("mqtt2sql_json_datapoints_total", kindCounter, "Datapoints decoded by JSONHandler", "decoder", "table")
+	rejectedMessages  = newMetric("mqtt2sql_json_rejected_total", kindCounter, "Messages JSONHandler was unable to decode", "decoder")
+	insertsDone       = newMetric("mqtt2sql_inserts_total", kindCounter, "Measurements inserted", "table")
+	insertsFailed     = newMetric("mqtt2sql_insert_failures_total", kindCounter, "Measurements not inserted", "table")
+	lateDatapoints    = newMetric("mqtt2sql_late_datapoints_total", kindCounter, "Datapoints older than the consolidated data", "table", "outcome")
+	consolidationTime = newMetric("mqtt2sql_consolidation_duration_seconds", kindSummary, "Duration of the consolidation", "dst_table")
+	consolidatedRows  = newMetric("mqtt2sql_consolidation_rows_total", kindCounter, "Rows inserted by the consolidation", "dst_table")
+	consolidationErrs = newMetric("mqtt2sql_consolidation_failures_total", kindCounter, "Consolidations rolled back", "dst_table")
+	retentionRows     = newMetric("mqtt2sql_retention_rows_total", kindCounter, "Rows deleted by the retention policies", "table")
+	retentionParts    = newMetric("mqtt2sql_retention_partitions_total", kindCounter, "Partitions dropped by the retention", "table")
+	dbConnections     = newMetric("mqtt2sql_db_connections", kindGauge, "Database connections of the pool", "pool", "state")
+	dbWaits           = newMetric("mqtt2sql_db_wait_total", kindCounter, "Waits for a database connection", "pool")
+	dbWaitTime        = newMetric("mqtt2sql_db_wait_seconds_total", kindCounter, "Time spent waiting for a database connection", "pool")
+	queueDepth        = newMetric("mqtt2sql_queue_depth", kindGauge, "Values waiting in the queue of a stage", "stage")
+	queueCapacity     = newMetric("mqtt2sql_queue_capacity", kindGauge, "Capacity of the queue of a stage", "stage")
+	queuePushed       = newMetric("mqtt2sql_queue_pushed_total", kindCounter, "Values pushed in the queue of a stage", "stage")
+	queueDropped      = newMetric("mqtt2sql_queue_dropped_total", kindCounter, "Values dropped by the queue of a stage", "stage")
+	queueSpilled      = newMetric("mqtt2sql_queue_spilled_total", kindCounter, "Values spilled to disk by the queue of a stage", "stage")
+)
+
+func init() {
+	onScrape(func() {
+		for _, st := range getQueueStats() {
+			queueDepth.set(float64(st.depth), st.stage)
+			queueCapacity.set(float64(st.capacity), st.stage)
+			queuePushed.set(float64(st.pushed), st.stage)
+			queueDropped.set(float64(st.dropped), st.stage)
+			queueSpilled.set(float64(st.spilled), st.stage)
+		}
+	})
+}
+
+func newMetric(name string, kind string, help string, labels ...string) *metric {
+	m := &metric{name: name, kind: kind, help: help, labels: labels, samples: make(map[string]*sample)}
+	metricsMu.Lock()
+	metrics = append(metrics, m)
+	metricsMu.Unlock()
+	return m
+}
+
+// onScrape registers a function called before the metrics are written
+func onScrape(f func()) {
+	metricsMu.Lock()
+	scrapeHooks = append(scrapeHooks, f)
+	metricsMu.Unlock()
+}
+
+func (m *metric) sample(values []string) *sample {
+	key := strings.Join(values, "\xff")
+	s, ok := m.samples[key]
+	if !ok {
+		s = &sample{labels: slices.Clone(values)}
+		m.samples[key] = s
+	}
+	return s
+}
+
+func (m *metric) add(v float64, values ...string) {
+	m.mu.Lock()
+	m.sample(values).value += v
+	m.mu.Unlock()
+}
+
+func (m *metric) inc(values ...string) {
+	m.add(1, values...)
+}
+
+func (m *metric) set(v float64, values ...string) {
+	m.mu.Lock()
+	m.sample(values).value = v
+	m.mu.Unlock()
+}
+
+func (m *metric) observe(v float64, values ...string) {
+	m.mu.Lock()
+	s := m.sample(values)
+	s.value += v
+	s.count++
+	m.mu.Unlock()
+}
+
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.samples))
+	for k := range m.samples {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		s := m.samples[k]
+		labels := m.labelString(s.labels)
+		if m.kind == kindSummary {
+			fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labels, formatValue(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", m.name, labels, s.count)
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labels, formatValue(s.value))
+		}
+	}
+}
+
+func (m *metric) labelString(values []string) string {
+	if len(m.labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(m.labels))
+	for i, l := range m.labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = l + `="` + escapeLabel(v) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	hooks := slices.Clone(scrapeHooks)
+	all := slices.Clone(metrics)
+	metricsMu.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range all {
+		m.write(w)
+	}
+}
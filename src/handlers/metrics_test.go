@@ -0,0 +1,95 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// value returns the value of the sample of the labels, 0 if none
+func (m *metric) value(values ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.samples[strings.Join(values, "\xff")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func TestConsolidatedRowsCommitted(t *testing.T) {
+	defer SetDeletePolicy("10000", 0, false)
+	measReceived = make(map[string]int64)
+
+	item := Item{src: "measurements_t", src_delete: "yes", dst: "t_rows", alist: "AVG(value)", clist: "vavg", period: 3600, bucket: secondsBucketer{3600}}
+	tests := []struct {
+		name     string
+		deferred bool
+		commit   error
+		want     float64
+	}{
+		{"committed", false, nil, 5},
+		{"commit failed", false, errors.New("lost"), 0},
+		{"deferred delete", true, nil, 5},
+		{"deferred commit failed", true, errors.New("lost"), 0},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		f.on(`^INSERT INTO t_rows`, fakeReply{affected: 5})
+		f.on(`^COMMIT$`, fakeReply{err: tt.commit})
+		SetDeletePolicy("10000", 0, tt.deferred)
+		before := consolidatedRows.value(item.dst)
+		db.ConsolidateItem(t.Context(), item, 0, 7200)
+		if got := consolidatedRows.value(item.dst) - before; got != tt.want {
+			t.Errorf("%s: %v rows counted, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDatapointsByTable(t *testing.T) {
+	ich := make(chan Message, 3)
+	ich <- Message{Topic: "sensors/a", Payload: []byte(`{"measurement": "t_by_table", "fields": {"value": 1}, "timestamp": 1000}`)}
+	ich <- Message{Topic: "sensors/b", Payload: []byte(`[{"measurement": "t_by_table", "fields": {"value": 2}, "timestamp": 1000}, {"measurement": "h_by_table", "fields": {"value": 3}, "timestamp": 1000}]`)}
+	ich <- Message{Topic: "sensors/c", Payload: []byte(`{"measurement": "sensor_status", "fields": {"value": 1}, "timestamp": 1000}`)}
+	close(ich)
+
+	t0, h0, s0 := parsedDatapoints.value("json", "measurements_t_by_table"), parsedDatapoints.value("json", "measurements_h_by_table"), parsedDatapoints.value("json", statusTable)
+	for range JSONHandler(ich) {
+	}
+	// the labels are the tables, whatever the topics
+	tests := []struct {
+		table string
+		from  float64
+		want  float64
+	}{
+		{"measurements_t_by_table", t0, 2},
+		{"measurements_h_by_table", h0, 1},
+		{statusTable, s0, 1},
+	}
+	for _, tt := range tests {
+		if got := parsedDatapoints.value("json", tt.table) - tt.from; got != tt.want {
+			t.Errorf("%s: %v datapoints counted, want %v", tt.table, got, tt.want)
+		}
+	}
+	for _, topic := range []string{"sensors/a", "sensors/b", "sensors/c"} {
+		if parsedDatapoints.value("json", topic) != 0 {
+			t.Errorf("datapoints counted for topic %s", topic)
+		}
+	}
+}
@@ -17,6 +17,10 @@
 
 package handlers
 
+import (
+	"time"
+)
+
 type Datapoint struct {
 	Measurement string `json:"measurement"`
 	Fields      struct {
@@ -29,3 +33,20 @@ type Datapoint struct {
 	} `json:"tags"`
 	Timestamp int64 `json:"timestamp"`
 }
+
+type Message struct {
+	Topic    string
+	Payload  []byte
+	QoS      byte
+	Retained bool
+	Received time.Time
+}
+
+// receivedMilli returns the reception time of a message, the one of its
+// capture when replayed, or now when unknown, in milliseconds
+func receivedMilli(received time.Time) int64 {
+	if received.IsZero() {
+		return time.Now().UnixMilli()
+	}
+	return received.UnixMilli()
+}
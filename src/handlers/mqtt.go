@@ -18,25 +18,66 @@
 package handlers
 
 import (
-	"fmt"
+	"context"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"log/slog"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
-func MQTTHandler(brokerURL string, subtopic string) chan string {
-	c := make(chan string, 10)
+var (
+	resubscribe = make(chan string, 1)
+	mqttMu      sync.Mutex
+	mqttTopics  []string // topics subscribed
+	mqttReady   bool     // connected and subscribed
+)
+
+// Resubscribe changes the topics subscribed by the running MQTTHandler
+func Resubscribe(subtopic string) {
+	select {
+	case <-resubscribe:
+	default:
+	}
+	resubscribe <- subtopic
+}
+
+// MQTTHandler subscribes to a comma separated list of topics, until the
+// context is done: then it unsubscribes, disconnects and closes its
+// output
+func MQTTHandler(ctx context.Context, brokerURL string, subtopic string) chan Message {
+	q := newQueue[Message]("mqtt")
 
 	var messagePubHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-		buff := fmt.Sprintf("%s", msg.Payload())
-		slog.Debug("Message received", "topic", msg.Topic(), "payload", buff)
-		c <- buff
+		if isSparkplugTopic(msg.Topic()) {
+			slog.Debug("Message received", "topic", msg.Topic(), "size", len(msg.Payload()))
+		} else {
+			slog.Debug("Message received", "topic", msg.Topic(), "payload", string(msg.Payload()))
+		}
+		mqttReceived.inc()
+		q.push(Message{
+			Topic:    msg.Topic(),
+			Payload:  msg.Payload(),
+			QoS:      msg.Qos(),
+			Retained: msg.Retained(),
+			Received: time.Now(),
+		})
 	}
 
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(brokerURL)
 	opts.SetDefaultPublishHandler(messagePubHandler)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		mqttConnected.set(1)
+		// the session is clean, the subscriptions are lost on reconnection
+		go subscribeAgain(client)
+	})
 	opts.SetConnectionLostHandler(func(client mqtt.Client, reason error) {
+		mqttConnected.set(0)
+		mqttMu.Lock()
+		mqttReady = false
+		mqttMu.Unlock()
 		slog.Warn("MQTT connection lost", "broker", brokerURL, "reason", reason.Error())
 	})
 	opts.SetAutoReconnect(true)
@@ -51,12 +92,109 @@ func MQTTHandler(brokerURL string, subtopic string) chan string {
 		slog.Info("Connected", "broker", brokerURL)
 	}
 
-	if token := mqttcli.Subscribe(subtopic, 1, nil); token.Wait() && token.Error() != nil {
-		slog.Error("MQTT subscribe", "topic", subtopic, "error", token.Error())
+	if !resubscribeTopics(mqttcli, subtopic) {
+		mqttcli.Disconnect(250)
 		return nil
-	} else {
-		slog.Info("Subscribed", "topic", subtopic)
 	}
 
-	return c
+	onReady("mqtt", func(ctx context.Context, maxAge time.Duration) (bool, map[string]any) {
+		mqttMu.Lock()
+		defer mqttMu.Unlock()
+		connected := mqttcli.IsConnectionOpen()
+		return connected && mqttReady, map[string]any{"connected": connected, "subscribed": mqttReady, "topics": mqttTopics}
+	})
+
+	go func() {
+		for {
+			select {
+			case s := <-resubscribe:
+				resubscribeTopics(mqttcli, s)
+			case <-ctx.Done():
+				mqttMu.Lock()
+				topics := slices.Clone(mqttTopics)
+				mqttReady = false
+				mqttMu.Unlock()
+				if token := mqttcli.Unsubscribe(topics...); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+					slog.Warn("MQTT unsubscribe", "topic", topics, "error", token.Error())
+				} else {
+					slog.Info("Unsubscribed", "topic", topics)
+				}
+				mqttcli.Disconnect(250)
+				mqttConnected.set(0)
+				slog.Info("Disconnected", "broker", brokerURL)
+				q.close()
+				return
+			}
+		}
+	}()
+
+	return q.c
+}
+
+// resubscribeTopics moves the subscriptions from the topics currently
+// subscribed to the comma separated list of topics, it returns false
+// when nothing is subscribed
+func resubscribeTopics(mqttcli mqtt.Client, subtopic string) bool {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+
+	var wanted, added, removed []string
+	for _, topic := range strings.Split(subtopic, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" && !slices.Contains(wanted, topic) {
+			wanted = append(wanted, topic)
+		}
+	}
+	for _, topic := range wanted {
+		if !slices.Contains(mqttTopics, topic) {
+			added = append(added, topic)
+		}
+	}
+	for _, topic := range mqttTopics {
+		if !slices.Contains(wanted, topic) {
+			removed = append(removed, topic)
+		}
+	}
+
+	if len(removed) > 0 {
+		if token := mqttcli.Unsubscribe(removed...); token.Wait() && token.Error() != nil {
+			slog.Error("MQTT unsubscribe", "topic", removed, "error", token.Error())
+		} else {
+			slog.Info("Unsubscribed", "topic", removed)
+			mqttTopics = slices.DeleteFunc(mqttTopics, func(t string) bool { return slices.Contains(removed, t) })
+		}
+	}
+	if len(added) > 0 {
+		if token := mqttcli.SubscribeMultiple(topicFilters(added), nil); token.Wait() && token.Error() != nil {
+			slog.Error("MQTT subscribe", "topic", added, "error", token.Error())
+		} else {
+			slog.Info("Subscribed", "topic", added)
+			mqttTopics = append(mqttTopics, added...)
+		}
+	}
+	mqttReady = len(mqttTopics) > 0
+	return mqttReady
+}
+
+// subscribeAgain restores the subscriptions after a reconnection
+func subscribeAgain(mqttcli mqtt.Client) {
+	mqttMu.Lock()
+	defer mqttMu.Unlock()
+
+	if len(mqttTopics) == 0 {
+		return
+	}
+	if token := mqttcli.SubscribeMultiple(topicFilters(mqttTopics), nil); token.Wait() && token.Error() != nil {
+		slog.Error("MQTT subscribe", "topic", mqttTopics, "error", token.Error())
+		return
+	}
+	slog.Info("Subscribed again", "topic", mqttTopics)
+	mqttReady = true
+}
+
+func topicFilters(topics []string) map[string]byte {
+	filters := make(map[string]byte)
+	for _, topic := range topics {
+		filters[topic] = 1
+	}
+	return filters
 }
@@ -0,0 +1,286 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The measurement and consolidated tables may be created partitioned by
+// range of ts, one partition per UTC day or month named after its first
+// day, p20250301 or p202503, and a pmax partition for the data beyond.
+// The upcoming partitions are created ahead and the expired ones are
+// dropped, instead of deleting their rows, as the retention of the
+// table. Only MariaDB is supported, the partitioned measurement tables
+// have a DECIMAL ts since a DOUBLE can't be partitioned
+type partitionPolicy struct {
+	unit  string // day or month, empty for no partitioning
+	ahead int    // partitions created ahead of the current one
+}
+
+type partition struct {
+	name  string
+	bound int64 // ts less than, MaxInt64 for pmax
+}
+
+const maxPartition = "pmax"
+
+var (
+	partitionMu sync.Mutex
+	partitions  = partitionPolicy{ahead: 3}
+	partitioned = map[string]bool{}
+)
+
+// SetPartitioning changes the partitioning of the tables created from
+// now on, unit being day, month or empty for none
+func SetPartitioning(unit string, ahead int) error {
+	if err := CheckPartitioning(unit, ahead); err != nil {
+		return err
+	}
+	partitionMu.Lock()
+	partitions = partitionPolicy{unit, ahead}
+	partitionMu.Unlock()
+	return nil
+}
+
+// CheckPartitioning tells whether SetPartitioning would accept the
+// partitioning
+func CheckPartitioning(unit string, ahead int) error {
+	if unit != "" && unit != "day" && unit != "month" {
+		return fmt.Errorf("bad partition unit %q, expected day or month", unit)
+	}
+	if ahead < 1 {
+		return fmt.Errorf("bad partition count %d, at least 1 expected", ahead)
+	}
+	return nil
+}
+
+func getPartitioning() partitionPolicy {
+	partitionMu.Lock()
+	defer partitionMu.Unlock()
+	return partitions
+}
+
+func isPartitioned(table string) bool {
+	partitionMu.Lock()
+	defer partitionMu.Unlock()
+	return partitioned[table]
+}
+
+func setPartitioned(tables []string) {
+	set := make(map[string]bool)
+	for _, table := range tables {
+		set[table] = true
+	}
+	partitionMu.Lock()
+	partitioned = set
+	partitionMu.Unlock()
+}
+
+// partitionStart returns the start of the partition holding t
+func (p partitionPolicy) partitionStart(t time.Time) time.Time {
+	t = t.UTC()
+	if p.unit == "month" {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func (p partitionPolicy) partitionNext(t time.Time) time.Time {
+	if p.unit == "month" {
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+func (p partitionPolicy) partitionName(t time.Time) string {
+	if p.unit == "month" {
+		return t.Format("p200601")
+	}
+	return t.Format("p20060102")
+}
+
+// upcoming returns the definitions of the partitions starting at from,
+// or of the current one if later, up to the ones ahead of now
+func (p partitionPolicy) upcoming(from time.Time, now time.Time) []string {
+	last := p.partitionStart(now)
+	for range p.ahead {
+		last = p.partitionNext(last)
+	}
+	var defs []string
+	t := p.partitionStart(now)
+	if from.After(t) {
+		t = from
+	}
+	for ; !t.After(last); t = p.partitionNext(t) {
+		defs = append(defs, fmt.Sprintf("PARTITION %s VALUES LESS THAN (%d)", p.partitionName(t), p.partitionNext(t).Unix()))
+	}
+	return defs
+}
+
+// partitionClause returns the PARTITION BY clause of a new table, the
+// data older than the current partition goes to the first one
+func partitionClause(expr string) string {
+	p := getPartitioning()
+	if p.unit == "" {
+		return ""
+	}
+	defs := p.upcoming(time.Time{}, time.Now())
+	defs = append(defs, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", maxPartition))
+	return fmt.Sprintf("\n\tPARTITION BY RANGE (%s) (%s)", expr, strings.Join(defs, ", "))
+}
+
+// readPartitions returns the partitions of the table, none when it is
+// not partitioned
+func (db *DB) readPartitions(table string) ([]partition, error) {
+	cmd := `
+	SELECT partition_name, partition_description FROM information_schema.partitions
+	WHERE table_schema = DATABASE() AND table_name = ? AND partition_name IS NOT NULL
+	ORDER BY partition_ordinal_position;
+	`
+	rows, err := db.Query(cmd, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []partition
+	for rows.Next() {
+		var p partition
+		var desc string
+		if err := rows.Scan(&p.name, &desc); err != nil {
+			return nil, err
+		}
+		if p.bound, err = strconv.ParseInt(desc, 10, 64); err != nil {
+			p.bound = math.MaxInt64
+		}
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// MaintainPartitions creates the upcoming partitions of the partitioned
+// tables and drops the ones beyond the retention of the dispatching
+// items
+func (db *DB) MaintainPartitions(ctx context.Context, items []Item) bool {
+	cmd := `
+	SELECT DISTINCT table_name FROM information_schema.partitions
+	WHERE table_schema = DATABASE() AND partition_name = ?;
+	`
+	rows, err := db.QueryContext(ctx, cmd, maxPartition)
+	if err != nil {
+		slog.Error("Unable to query", "table", "information_schema.partitions", "err", err)
+		return false
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err == nil {
+			tables = append(tables, table)
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		slog.Error("Unable to fetch", "table", "information_schema.partitions", "err", err)
+		return false
+	}
+	setPartitioned(tables)
+
+	ok := true
+	now := time.Now()
+	for _, table := range tables {
+		if ctx.Err() != nil {
+			return false
+		}
+		if !db.addPartitions(table, now) {
+			ok = false
+		}
+		for _, item := range items {
+			if item.dst == table && item.retention > 0 && !db.dropPartitions(table, now.Unix()-item.retention) {
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// addPartitions splits pmax to create the partitions up to the ones
+// ahead of now
+func (db *DB) addPartitions(table string, now time.Time) bool {
+	parts, err := db.readPartitions(table)
+	if err != nil {
+		slog.Error("Unable to query", "table", table, "err", err)
+		return false
+	}
+	if len(parts) < 2 || parts[len(parts)-1].name != maxPartition {
+		return true
+	}
+	p := getPartitioning()
+	// the unit of a table is the one of its partitions
+	p.unit = "day"
+	if len(parts[0].name) == len("p200601") {
+		p.unit = "month"
+	}
+	defs := p.upcoming(time.Unix(parts[len(parts)-2].bound, 0), now)
+	if len(defs) == 0 {
+		return true
+	}
+	defs = append(defs, fmt.Sprintf("PARTITION %s VALUES LESS THAN MAXVALUE", maxPartition))
+	cmd := fmt.Sprintf("ALTER TABLE %s REORGANIZE PARTITION %s INTO (%s);", table, maxPartition, strings.Join(defs, ", "))
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to add partitions", "table", table, "cmd", cmd, "err", err)
+		return false
+	}
+	slog.Info("Partitions added", "table", table, "count", len(defs)-1)
+	return true
+}
+
+// dropPartitions drops the partitions whose data is entirely before the
+// cutoff, the data of the partition holding the cutoff is kept
+func (db *DB) dropPartitions(table string, cutoff int64) bool {
+	parts, err := db.readPartitions(table)
+	if err != nil {
+		slog.Error("Unable to query", "table", table, "err", err)
+		return false
+	}
+	var names []string
+	for _, p := range parts {
+		if p.name != maxPartition && p.bound <= cutoff {
+			names = append(names, p.name)
+		}
+	}
+	if len(names) == 0 {
+		return true
+	}
+	cmd := fmt.Sprintf("ALTER TABLE %s DROP PARTITION %s;", table, strings.Join(names, ", "))
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to drop partitions", "table", table, "cmd", cmd, "err", err)
+		return false
+	}
+	slog.Info("Partitions dropped", "table", table, "partitions", strings.Join(names, ", "), "cutoff", cutoff)
+	retentionParts.add(float64(len(names)), table)
+	return true
+}
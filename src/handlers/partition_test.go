@@ -0,0 +1,132 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"database/sql/driver"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSetPartitioning(t *testing.T) {
+	defer SetPartitioning("", 3)
+
+	tests := []struct {
+		unit  string
+		ahead int
+		err   bool
+	}{
+		{"", 3, false},
+		{"day", 1, false},
+		{"month", 12, false},
+		{"week", 3, true},
+		{"day", 0, true},
+	}
+	for _, tt := range tests {
+		if err := SetPartitioning(tt.unit, tt.ahead); (err != nil) != tt.err {
+			t.Errorf("SetPartitioning(%q, %d) error %v, want error %v", tt.unit, tt.ahead, err, tt.err)
+		}
+	}
+}
+
+func TestUpcomingPartitions(t *testing.T) {
+	now := time.Date(2025, 12, 30, 15, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		p    partitionPolicy
+		from time.Time
+		want []string
+	}{
+		{"days", partitionPolicy{"day", 2}, time.Time{}, []string{
+			"PARTITION p20251230 VALUES LESS THAN (1767139200)",
+			"PARTITION p20251231 VALUES LESS THAN (1767225600)",
+			"PARTITION p20260101 VALUES LESS THAN (1767312000)",
+		}},
+		{"months", partitionPolicy{"month", 1}, time.Time{}, []string{
+			"PARTITION p202512 VALUES LESS THAN (1767225600)",
+			"PARTITION p202601 VALUES LESS THAN (1769904000)",
+		}},
+		{"from the last one", partitionPolicy{"day", 2}, time.Date(2025, 12, 31, 0, 0, 0, 0, time.UTC), []string{
+			"PARTITION p20251231 VALUES LESS THAN (1767225600)",
+			"PARTITION p20260101 VALUES LESS THAN (1767312000)",
+		}},
+		{"up to date", partitionPolicy{"day", 2}, time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC), nil},
+	}
+	for _, tt := range tests {
+		if got := tt.p.upcoming(tt.from, now); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: upcoming\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaintainPartitions(t *testing.T) {
+	defer SetPartitioning("", 3)
+	defer setPartitioned(nil)
+
+	day := int64(86400)
+	today := time.Now().Unix() / day * day
+	name := func(ts int64) string { return time.Unix(ts, 0).UTC().Format("p20060102") }
+	tests := []struct {
+		name      string
+		parts     []int64 // starts of the day partitions
+		retention int64
+		add       bool
+		drop      []string
+	}{
+		{"up to date", []int64{today, today + day}, 0, false, nil},
+		{"behind", []int64{today - 2*day, today - day}, 0, true, nil},
+		{"expired", []int64{today - 3*day, today - 2*day, today - day, today, today + day}, 2 * day, false, []string{name(today - 3*day)}},
+	}
+	for _, tt := range tests {
+		if err := SetPartitioning("day", 1); err != nil {
+			t.Fatal(err)
+		}
+		f, db := newFakeDB(t)
+		f.on(`SELECT DISTINCT table_name FROM information_schema\.partitions`, fakeReply{
+			cols: []string{"table_name"},
+			rows: [][]driver.Value{{"t_hourly"}},
+		})
+		rows := [][]driver.Value{}
+		for _, ts := range tt.parts {
+			rows = append(rows, []driver.Value{name(ts), strconv.FormatInt(ts+day, 10)})
+		}
+		rows = append(rows, []driver.Value{maxPartition, "MAXVALUE"})
+		f.on(`FROM information_schema\.partitions WHERE`, fakeReply{cols: []string{"partition_name", "partition_description"}, rows: rows})
+
+		item := Item{src: "measurements_t", dst: "t_hourly", period: 3600, retention: tt.retention}
+		if !db.MaintainPartitions(t.Context(), []Item{item}) {
+			t.Errorf("%s: MaintainPartitions failed", tt.name)
+		}
+		if !isPartitioned("t_hourly") {
+			t.Errorf("%s: t_hourly not partitioned", tt.name)
+		}
+		if add := len(f.executed(`REORGANIZE PARTITION pmax`)) > 0; add != tt.add {
+			t.Errorf("%s: partitions added %v, want %v", tt.name, add, tt.add)
+		}
+		var drop []string
+		for _, c := range f.executed(`DROP PARTITION`) {
+			drop = append(drop, strings.TrimSuffix(strings.SplitN(c.query, "DROP PARTITION ", 2)[1], ";"))
+		}
+		if !slices.Equal(drop, tt.drop) {
+			t.Errorf("%s: partitions dropped %v, want %v", tt.name, drop, tt.drop)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Overflow policies of the queues between the pipeline stages
+const (
+	policyBlock      = "block"
+	policyDropOldest = "drop-oldest"
+	policyDropNewest = "drop-newest"
+	policySpill      = "spill"
+)
+
+type queueConfig struct {
+	capacity int
+	policy   string
+}
+
+type queueStat struct {
+	stage    string
+	capacity int
+	policy   string
+	depth    int
+	pushed   int64
+	dropped  int64
+	spilled  int64
+}
+
+// queue is the output channel of a stage, push applies the overflow
+// policy when the channel is full
+type queue[T any] struct {
+	stage   string
+	c       chan T
+	policy  string
+	mu      sync.RWMutex
+	closed  bool
+	spill   *spill[T]
+	pushed  atomic.Int64
+	dropped atomic.Int64
+}
+
+// spill keeps the overflow of a queue in a file, in order, until the
+// channel has room again
+type spill[T any] struct {
+	c       chan T
+	mu      sync.Mutex
+	cond    *sync.Cond
+	w       *os.File
+	r       *bufio.Reader
+	rf      *os.File
+	pending int
+	total   atomic.Int64
+	closed  bool
+	done    chan struct{}
+}
+
+var (
+	queueConfigs = map[string]queueConfig{}
+	defaultQueue = queueConfig{capacity: 10, policy: policyBlock}
+	spillDir     = os.TempDir()
+	queuesMu     sync.Mutex
+	queueStats   []func() queueStat
+)
+
+// ConfigureQueues sets the channel capacities and the overflow policies
+// of the stages, as a default value optionally followed by per stage
+// values: "100,mqtt=1000" or "block,mqtt=spill"
+func ConfigureQueues(sizes string, policies string, dir string) error {
+	if dir != "" {
+		spillDir = dir
+	}
+	for _, s := range strings.Split(sizes, ",") {
+		stage, value := splitStage(s)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("bad queue size %q", s)
+		}
+		if stage == "" {
+			defaultQueue.capacity = n
+		} else {
+			qc := queueConfigOf(stage)
+			qc.capacity = n
+			queueConfigs[stage] = qc
+		}
+	}
+	for _, s := range strings.Split(policies, ",") {
+		stage, value := splitStage(s)
+		if value == "" {
+			continue
+		}
+		if !slices.Contains([]string{policyBlock, policyDropOldest, policyDropNewest, policySpill}, value) {
+			return fmt.Errorf("bad overflow policy %q", s)
+		}
+		if stage == "" {
+			defaultQueue.policy = value
+		} else {
+			qc := queueConfigOf(stage)
+			qc.policy = value
+			queueConfigs[stage] = qc
+		}
+	}
+	return nil
+}
+
+func splitStage(s string) (string, string) {
+	if stage, value, ok := strings.Cut(strings.TrimSpace(s), "="); ok {
+		return strings.TrimSpace(stage), strings.TrimSpace(value)
+	}
+	return "", strings.TrimSpace(s)
+}
+
+// queueConfigOf returns the configuration set for a stage, a negative
+// capacity or an empty policy stand for the default ones
+func queueConfigOf(stage string) queueConfig {
+	qc, ok := queueConfigs[stage]
+	if !ok {
+		return queueConfig{capacity: -1}
+	}
+	return qc
+}
+
+func newQueue[T any](stage string) *queue[T] {
+	qc := queueConfigOf(stage)
+	if qc.capacity < 0 {
+		qc.capacity = defaultQueue.capacity
+	}
+	if qc.policy == "" {
+		qc.policy = defaultQueue.policy
+	}
+
+	q := &queue[T]{stage: stage, c: make(chan T, qc.capacity), policy: qc.policy}
+	if q.policy == policySpill {
+		if s, err := newSpill(q); err != nil {
+			slog.Error("Unable to spill", "stage", stage, "dir", spillDir, "err", err)
+			q.policy = policyBlock
+		} else {
+			q.spill = s
+		}
+	}
+	slog.Debug("Queue", "stage", stage, "capacity", qc.capacity, "policy", q.policy)
+
+	queuesMu.Lock()
+	queueStats = append(queueStats, q.stat)
+	queuesMu.Unlock()
+
+	return q
+}
+
+func (q *queue[T]) push(v T) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		q.dropped.Add(1)
+		return
+	}
+	q.pushed.Add(1)
+
+	switch q.policy {
+	case policyDropNewest:
+		select {
+		case q.c <- v:
+		default:
+			q.dropped.Add(1)
+		}
+	case policyDropOldest:
+		for {
+			select {
+			case q.c <- v:
+				return
+			default:
+			}
+			select {
+			case <-q.c:
+				q.dropped.Add(1)
+			default:
+			}
+		}
+	case policySpill:
+		q.spill.push(v)
+	default:
+		q.c <- v
+	}
+}
+
+// close waits for the spilled values to be consumed before closing the
+// channel, late pushes are dropped
+func (q *queue[T]) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	if q.spill != nil {
+		q.spill.close()
+	}
+	close(q.c)
+}
+
+func (q *queue[T]) stat() queueStat {
+	st := queueStat{
+		stage:    q.stage,
+		capacity: cap(q.c),
+		policy:   q.policy,
+		depth:    len(q.c),
+		pushed:   q.pushed.Load(),
+		dropped:  q.dropped.Load(),
+	}
+	if q.spill != nil {
+		q.spill.mu.Lock()
+		st.depth += q.spill.pending
+		q.spill.mu.Unlock()
+		st.spilled = q.spill.total.Load()
+	}
+	return st
+}
+
+func getQueueStats() []queueStat {
+	queuesMu.Lock()
+	defer queuesMu.Unlock()
+	result := make([]queueStat, 0, len(queueStats))
+	for _, f := range queueStats {
+		result = append(result, f())
+	}
+	return result
+}
+
+func logQueueStats() {
+	for _, st := range getQueueStats() {
+		slog.Info(
+			"Queue",
+			"stage", st.stage,
+			"capacity", st.capacity,
+			"policy", st.policy,
+			"depth", st.depth,
+			"pushed", st.pushed,
+			"dropped", st.dropped,
+			"spilled", st.spilled)
+	}
+}
+
+func newSpill[T any](q *queue[T]) (*spill[T], error) {
+	w, err := os.CreateTemp(spillDir, "mqtt2sql-spill-"+q.stage+"-*")
+	if err != nil {
+		return nil, err
+	}
+	rf, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	// the file is only reachable through the descriptors
+	os.Remove(w.Name())
+
+	s := &spill[T]{c: q.c, w: w, rf: rf, r: bufio.NewReader(rf), done: make(chan struct{})}
+	s.cond = sync.NewCond(&s.mu)
+	go s.drain()
+	return s, nil
+}
+
+// push sends directly to the channel while nothing is spilled, so that
+// the order of the values is kept
+func (s *spill[T]) push(v T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == 0 {
+		select {
+		case s.c <- v:
+			return
+		default:
+		}
+	}
+	s.write(v)
+}
+
+func (s *spill[T]) write(v T) {
+	buff, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Unable to spill", "err", err)
+		return
+	}
+	if _, err := s.w.Write(append(buff, '\n')); err != nil {
+		slog.Error("Unable to spill", "file", s.w.Name(), "err", err)
+		return
+	}
+	s.pending++
+	s.total.Add(1)
+	s.cond.Signal()
+}
+
+func (s *spill[T]) drain() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		for s.pending == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.pending == 0 {
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		line, err := s.r.ReadBytes('\n')
+		var v T
+		if err == nil {
+			err = json.Unmarshal(line, &v)
+		}
+		if err != nil {
+			slog.Error("Unable to read spill", "file", s.w.Name(), "err", err)
+		} else {
+			s.c <- v
+		}
+
+		s.mu.Lock()
+		s.pending--
+		if s.pending == 0 {
+			// everything is consumed, the file can be reclaimed
+			s.w.Truncate(0)
+			s.w.Seek(0, io.SeekStart)
+			s.rf.Seek(0, io.SeekStart)
+			s.r.Reset(s.rf)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *spill[T]) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Signal()
+	s.mu.Unlock()
+	<-s.done
+	s.w.Close()
+	s.rf.Close()
+}
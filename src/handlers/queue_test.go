@@ -0,0 +1,163 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"maps"
+	"slices"
+	"testing"
+)
+
+// resetQueues restores the queue configuration when the test ends
+func resetQueues(t *testing.T) {
+	configs, def, dir := maps.Clone(queueConfigs), defaultQueue, spillDir
+	t.Cleanup(func() {
+		queueConfigs, defaultQueue, spillDir = configs, def, dir
+	})
+	queueConfigs = map[string]queueConfig{}
+	defaultQueue = queueConfig{capacity: 10, policy: policyBlock}
+}
+
+func TestConfigureQueues(t *testing.T) {
+	tests := []struct {
+		sizes    string
+		policies string
+		want     map[string]queueConfig
+		err      bool
+	}{
+		{"", "", map[string]queueConfig{"": {10, policyBlock}, "mqtt": {10, policyBlock}}, false},
+		{"100", "spill", map[string]queueConfig{"": {100, policySpill}, "mqtt": {100, policySpill}}, false},
+		{"100, mqtt=1000", "block,mqtt=drop-oldest", map[string]queueConfig{
+			"":     {100, policyBlock},
+			"mqtt": {1000, policyDropOldest},
+			"sql":  {100, policyBlock},
+		}, false},
+		{"mqtt=0", "sql=drop-newest", map[string]queueConfig{
+			"":     {10, policyBlock},
+			"mqtt": {0, policyBlock},
+			"sql":  {10, policyDropNewest},
+		}, false},
+		{"-1", "", nil, true},
+		{"mqtt=many", "", nil, true},
+		{"", "mqtt=drop", nil, true},
+	}
+	for _, tt := range tests {
+		resetQueues(t)
+		err := ConfigureQueues(tt.sizes, tt.policies, "")
+		if (err != nil) != tt.err {
+			t.Errorf("ConfigureQueues(%q, %q) error %v, want error %v", tt.sizes, tt.policies, err, tt.err)
+			continue
+		}
+		for stage, want := range tt.want {
+			got := defaultQueue
+			if stage != "" {
+				q := newQueue[int](stage)
+				got = queueConfig{cap(q.c), q.policy}
+			}
+			if got != want {
+				t.Errorf("ConfigureQueues(%q, %q) stage %q: %+v, want %+v", tt.sizes, tt.policies, stage, got, want)
+			}
+		}
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	tests := []struct {
+		policy  string
+		want    []int
+		dropped int64
+		spilled int64
+	}{
+		{policyDropNewest, []int{1, 2}, 3, 0},
+		{policyDropOldest, []int{4, 5}, 3, 0},
+		{policySpill, []int{1, 2, 3, 4, 5}, 0, 3},
+	}
+	for _, tt := range tests {
+		resetQueues(t)
+		spillDir = t.TempDir()
+		if err := ConfigureQueues("2", tt.policy, ""); err != nil {
+			t.Fatal(err)
+		}
+		q := newQueue[int]("test")
+		// nothing is consumed until every value is pushed
+		for v := 1; v <= 5; v++ {
+			q.push(v)
+		}
+		st := q.stat()
+		if st.pushed != 5 || st.dropped != tt.dropped || st.spilled != tt.spilled {
+			t.Errorf("%s: pushed %d dropped %d spilled %d, want 5 %d %d", tt.policy, st.pushed, st.dropped, st.spilled, tt.dropped, tt.spilled)
+		}
+		if want := len(tt.want); st.depth != want {
+			t.Errorf("%s: depth %d, want %d", tt.policy, st.depth, want)
+		}
+
+		got := make(chan []int)
+		go func() {
+			var values []int
+			for v := range q.c {
+				values = append(values, v)
+			}
+			got <- values
+		}()
+		q.close()
+		if values := <-got; !slices.Equal(values, tt.want) {
+			t.Errorf("%s: received %v, want %v", tt.policy, values, tt.want)
+		}
+
+		// the values pushed once closed are dropped
+		q.push(6)
+		if st := q.stat(); st.dropped != tt.dropped+1 {
+			t.Errorf("%s: dropped %d after close, want %d", tt.policy, st.dropped, tt.dropped+1)
+		}
+	}
+}
+
+func TestQueueSpillReuse(t *testing.T) {
+	resetQueues(t)
+	spillDir = t.TempDir()
+	if err := ConfigureQueues("1", "spill", ""); err != nil {
+		t.Fatal(err)
+	}
+	q := newQueue[Datapoint]("test")
+
+	// the spill file is reclaimed once drained and used again
+	var want []Datapoint
+	for round := range 3 {
+		for i := range 4 {
+			dp := Datapoint{Measurement: "t", Timestamp: int64(round*10 + i)}
+			dp.Fields.Value = float64(i) / 4
+			dp.Tags.ID = "sensor"
+			want = append(want, dp)
+			q.push(dp)
+		}
+		for range 4 {
+			if got := <-q.c; got != want[0] {
+				t.Fatalf("round %d: received %+v, want %+v", round, got, want[0])
+			}
+			want = want[1:]
+		}
+	}
+	// the drain may not have caught up with the consumer yet
+	if st := q.stat(); st.spilled < 9 {
+		t.Errorf("spilled %d, want at least 9", st.spilled)
+	}
+	q.close()
+	if _, ok := <-q.c; ok {
+		t.Error("channel not closed")
+	}
+}
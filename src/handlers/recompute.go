@@ -0,0 +1,204 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+// RecomputeOptions selects the buckets of a consolidated table to derive
+// again from its source, From and To are dates, local times or epochs
+type RecomputeOptions struct {
+	Rule   string
+	From   string
+	To     string
+	DryRun bool
+	Force  bool
+}
+
+// recomputation is the range of an item to delete and consolidate again
+type recomputation struct {
+	item   Item
+	t1, t2 int64
+}
+
+// Recompute deletes and consolidates again the buckets of the rule in
+// [From, To), then the buckets of the rules depending on it, in a single
+// transaction. The affected row counts are printed
+func Recompute(ctx context.Context, opts RecomputeOptions) bool {
+	from, ok := parseTime(opts.From)
+	if !ok {
+		slog.Error("Bad time", "from", opts.From)
+		return false
+	}
+	to, ok := parseTime(opts.To)
+	if !ok || !to.After(from) {
+		slog.Error("Bad time", "to", opts.To)
+		return false
+	}
+
+	db := newDB()
+	if db == nil {
+		return false
+	}
+	defer db.Close()
+	if !db.CheckSensorLayout() {
+		return false
+	}
+	items, ok := db.ReadOrCreateDispatchingTable()
+	if !ok {
+		return false
+	}
+	plan, ok := planRecomputation(items, opts.Rule, from.Unix(), to.Unix())
+	if !ok {
+		return false
+	}
+
+	// the source rows of a rule deleting them are gone, except late ones
+	for _, r := range plan {
+		if r.item.src_delete == "yes" && !opts.Force {
+			slog.Error("Source data deleted by the consolidation, use -force", "dst_table", r.item.dst, "src_table", r.item.src)
+			return false
+		}
+	}
+
+	tx, ok := db.BeginTransaction(ctx)
+	if !ok {
+		return false
+	}
+	defer tx.RollbackTransaction()
+
+	fmt.Printf("%-30s %-20s %-20s %10s %10s %10s\n", "table", "from", "to", "source", "before", "after")
+	for _, r := range plan {
+		src, ok1 := tx.CountRows(r.item.src, r.t1, r.t2, r.item.filter)
+		before, ok2 := tx.CountRows(r.item.dst, r.t1, r.t2, nil)
+		if !ok1 || !ok2 {
+			return false
+		}
+		if src == 0 && before > 0 && !opts.Force {
+			slog.Error("No source data, use -force", "dst_table", r.item.dst, "src_table", r.item.src, "t1", r.t1, "t2", r.t2)
+			return false
+		}
+		after := "-"
+		if !opts.DryRun {
+			if !tx.DeleteData(r.item.dst, r.t1, r.t2, nil) || !tx.InsertConsolidatedData(r.item, r.t1, r.t2) {
+				return false
+			}
+			if r.item.src_delete == "yes" && !tx.DeleteData(r.item.src, r.t1, r.t2, r.item.filter) {
+				return false
+			}
+			n, ok := tx.CountRows(r.item.dst, r.t1, r.t2, nil)
+			if !ok {
+				return false
+			}
+			after = fmt.Sprint(n)
+		}
+		fmt.Printf("%-30s %-20s %-20s %10d %10d %10s\n", r.item.dst, formatTime(r.t1), formatTime(r.t2), src, before, after)
+	}
+
+	if opts.DryRun {
+		slog.Info("Dry run, nothing changed")
+		return true
+	}
+	return tx.CommitTransaction()
+}
+
+// planRecomputation returns the rule and the rules depending on it, with
+// their ranges widened to their buckets. The items are in the order of
+// orderItems, a rule after its source whatever their ranks, so that the
+// rules depending on it are among the ones following it. The buckets
+// not consolidated yet are left to the consolidation
+func planRecomputation(items []Item, rule string, from int64, to int64) ([]recomputation, bool) {
+	idx := slices.IndexFunc(items, func(it Item) bool { return it.dst == rule })
+	if idx < 0 {
+		slog.Error("Unknown rule", "dst_table", rule)
+		return nil, false
+	}
+
+	var plan []recomputation
+	ranges := map[string][2]int64{}
+	add := func(item Item, from int64, to int64) {
+		t1 := item.bucket.floor(from)
+		t2 := item.bucket.floor(to)
+		if t2 < to {
+			t2 = item.bucket.next(to)
+		}
+		t2 = min(t2, item.bucket.floor(time.Now().Add(-getGrace()).Unix()))
+		if t2 > t1 {
+			plan = append(plan, recomputation{item, t1, t2})
+			ranges[item.dst] = [2]int64{t1, t2}
+		}
+	}
+	add(items[idx], from, to)
+	for _, item := range items[idx+1:] {
+		if r, ok := ranges[item.src]; ok {
+			add(item, r[0], r[1])
+		}
+	}
+	if len(plan) == 0 {
+		slog.Error("Nothing to recompute", "dst_table", rule)
+		return nil, false
+	}
+	return plan, true
+}
+
+// CountRows counts the rows of the table in [t1, t2) selected by the
+// filter, if any
+func (db *DB) CountRows(table string, t1 int64, t2 int64, f *Filter) (int64, bool) {
+	cmdTemplate := `
+	SELECT COUNT(*) FROM %s WHERE ts >= %d AND ts < %d%s;
+	`
+	filter, args := f.where()
+	cmd := fmt.Sprintf(cmdTemplate, table, t1, t2, filter)
+	rows, err := db.Query(cmd, args...)
+	if err != nil {
+		slog.Error("Unable to query", "table", table, "cmd", cmd, "err", err)
+		return 0, false
+	}
+	defer rows.Close()
+
+	var n int64
+	if rows.Next() {
+		if err := rows.Scan(&n); err != nil {
+			slog.Error("Unable to fetch", "table", table, "err", err)
+			return 0, false
+		}
+	}
+	return n, true
+}
+
+// parseTime parses a local date, or a time or an epoch as parseTimestamp
+// does: a local time, with a space or a T, an RFC 3339 time or seconds or
+// milliseconds since the epoch
+func parseTime(s string) (time.Time, bool) {
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, true
+	}
+	if ms, ok := parseTimestamp(s, ""); ok {
+		return time.UnixMilli(ms), true
+	}
+	return time.Time{}, false
+}
+
+func formatTime(t int64) string {
+	return time.Unix(t, 0).Format(time.DateTime)
+}
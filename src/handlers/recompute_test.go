@@ -0,0 +1,83 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPlanRecomputation(t *testing.T) {
+	// the daily rule depends on the hourly one despite its lower rank
+	items, errs := validateRules([]Rule{
+		testRule(1, "t_hourly", "t_daily", 86400, ""),
+		testRule(2, "measurements_t", "t_hourly", 3600, ""),
+		testRule(3, "measurements_h", "h_hourly", 3600, ""),
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	// 2025-03-01 10:30 to 12:00 UTC
+	plan, ok := planRecomputation(items, "t_hourly", 1740825000, 1740830400)
+	if !ok {
+		t.Fatal("nothing planned")
+	}
+	type planned struct {
+		dst    string
+		t1, t2 int64
+	}
+	var got []planned
+	for _, r := range plan {
+		got = append(got, planned{r.item.dst, r.t1, r.t2})
+	}
+	want := []planned{
+		{"t_hourly", 1740823200, 1740830400},
+		{"t_daily", 1740787200, 1740873600},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("plan %v, want %v", got, want)
+	}
+
+	if _, ok := planRecomputation(items, "t_weekly", 1740825000, 1740830400); ok {
+		t.Error("unknown rule planned")
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"2025-03-01", time.Date(2025, 3, 1, 0, 0, 0, 0, time.Local), true},
+		{"2025-03-01 10:30:00", time.Date(2025, 3, 1, 10, 30, 0, 0, time.Local), true},
+		{"2025-03-01T10:30:00", time.Date(2025, 3, 1, 10, 30, 0, 0, time.Local), true},
+		{"2025-03-01T10:30:00Z", time.Date(2025, 3, 1, 10, 30, 0, 0, time.UTC), true},
+		{"1740825000", time.Unix(1740825000, 0), true},
+		{"1740825000000", time.Unix(1740825000, 0), true},
+		{"2025-03-01 10:30", time.Time{}, false},
+		{"yesterday", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTime(tt.s)
+		if ok != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseTime(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+)
+
+// RetentionPolicy bounds the rows kept in the tables whose name matches
+// a LIKE pattern, e.g. measurements_%, by age, count or size, 0 being no
+// limit. The policies of a table all apply, so the strictest one wins.
+// The rows are deleted by whole seconds, a count or a size may keep a
+// few rows less than allowed.
+// A table read by dispatching items is trimmed only up to the data
+// they consolidated, and is kept for the late tolerance if its rows
+// may be consolidated again
+type RetentionPolicy struct {
+	pattern string
+	maxAge  int64 // seconds
+	maxRows int64
+	maxSize int64 // bytes
+}
+
+const retentionTable = "retention"
+
+func (db *DB) ReadOrCreateRetentionTable() ([]RetentionPolicy, bool) {
+	policies, err := db.ReadRetentionTable()
+	if err != nil {
+		slog.Warn("Unable to query", "table", retentionTable, "err", err)
+		if db.CreateRetentionTable() && db.CreateRetentionIndex() {
+			if policies, err = db.ReadRetentionTable(); err != nil {
+				slog.Error("Unable to query", "table", retentionTable, "err", err)
+				return nil, false
+			}
+		} else {
+			return nil, false
+		}
+	}
+	return policies, true
+}
+
+// CreateRetentionTable creates the table of the retention policies, the
+// age in hours and the size in megabytes
+func (db *DB) CreateRetentionTable() bool {
+	cmdTemplate := `
+	CREATE TABLE IF NOT EXISTS %s (
+		table_pattern TINYTEXT NOT NULL,
+		max_age INT UNSIGNED NOT NULL DEFAULT 0,
+		max_rows BIGINT UNSIGNED NOT NULL DEFAULT 0,
+		max_size BIGINT UNSIGNED NOT NULL DEFAULT 0
+	);
+	`
+	cmd := fmt.Sprintf(cmdTemplate, retentionTable)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to create", "table", retentionTable, "cmd", cmd, "err", err)
+		return false
+	}
+
+	slog.Info("Table created", "table", retentionTable)
+	return true
+}
+
+func (db *DB) CreateRetentionIndex() bool {
+	indexes := []Index{
+		Index{"idxret_table_pattern", "UNIQUE", retentionTable, "table_pattern"},
+	}
+	return db.CreateIndexes(indexes)
+}
+
+func (db *DB) ReadRetentionTable() ([]RetentionPolicy, error) {
+	cmdTemplate := `
+	SELECT table_pattern, max_age, max_rows, max_size FROM %s;
+	`
+	cmd := fmt.Sprintf(cmdTemplate, retentionTable)
+	rows, err := db.Query(cmd)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []RetentionPolicy
+	for rows.Next() {
+		var p RetentionPolicy
+		if err := rows.Scan(&p.pattern, &p.maxAge, &p.maxRows, &p.maxSize); err != nil {
+			slog.Error("Unable to fetch", "table", retentionTable, "err", err)
+			continue
+		}
+		p.maxAge *= 3600
+		p.maxSize *= 1024 * 1024
+		result = append(result, p)
+	}
+	return result, rows.Err()
+}
+
+// ApplyRetention deletes the rows beyond the policies, out of any
+// transaction and by chunks as set by SetDeletePolicy, until the context
+// is done
+func (db *DB) ApplyRetention(ctx context.Context, policies []RetentionPolicy, items []Item) bool {
+	ok := true
+	for _, p := range policies {
+		tables, err := db.matchingTables(p.pattern)
+		if err != nil {
+			slog.Error("Unable to query", "pattern", p.pattern, "err", err)
+			ok = false
+			continue
+		}
+		for _, table := range tables {
+			if ctx.Err() != nil {
+				return false
+			}
+			cutoff, found := db.retentionCutoff(table, p)
+			if !found {
+				continue
+			}
+			if bound := retentionBound(table, items); bound < cutoff {
+				slog.Debug("Retention held back", "table", table, "cutoff", cutoff, "bound", bound)
+				cutoff = bound
+			}
+			if cutoff <= 0 {
+				continue
+			}
+			// the ts of the raw tables are not whole seconds, the cutoff is
+			// rounded up and the rest of its second is deleted too
+			end := int64(math.Ceil(cutoff))
+			if isPartitioned(table) {
+				if !db.dropPartitions(table, end) {
+					ok = false
+				}
+				continue
+			}
+			affected, done := db.withContext(ctx).deleteData(table, 0, end, nil)
+			retentionRows.add(float64(affected), table)
+			if !done {
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// matchingTables returns the tables of the database matching the pattern
+func (db *DB) matchingTables(pattern string) ([]string, error) {
+	cmd := `
+	SELECT table_name FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name LIKE ?;
+	`
+	rows, err := db.Query(cmd, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		tables = append(tables, table)
+	}
+	return tables, rows.Err()
+}
+
+// retentionCutoff returns the ts before which the rows of the table are
+// beyond the policy, if any. Beyond a count or a size, the cutoff is just
+// after the newest row to delete
+func (db *DB) retentionCutoff(table string, p RetentionPolicy) (float64, bool) {
+	var cutoff float64
+	if p.maxAge > 0 {
+		cutoff = float64(time.Now().Unix() - p.maxAge)
+	}
+	if p.maxRows == 0 && p.maxSize == 0 {
+		return cutoff, cutoff > 0
+	}
+
+	var count, size int64
+	cmd := `
+	SELECT table_rows, data_length + index_length FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name = ?;
+	`
+	if err := db.QueryRow(cmd, table).Scan(&count, &size); err != nil {
+		slog.Error("Unable to query", "table", table, "cmd", cmd, "err", err)
+		return cutoff, cutoff > 0
+	}
+	// the statistics are estimates, the exact count is read when close
+	keep := int64(-1)
+	if p.maxRows > 0 && count > p.maxRows/2 {
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s;", table)).Scan(&count); err != nil {
+			slog.Error("Unable to query", "table", table, "err", err)
+			return cutoff, cutoff > 0
+		}
+		if count > p.maxRows {
+			keep = p.maxRows
+		}
+	}
+	if p.maxSize > 0 && size > p.maxSize && count > 0 {
+		if k := count * p.maxSize / size; keep < 0 || k < keep {
+			keep = k
+		}
+	}
+	if keep < 0 {
+		return cutoff, cutoff > 0
+	}
+
+	var ts float64
+	cmd = fmt.Sprintf("SELECT ts FROM %s ORDER BY ts DESC LIMIT 1 OFFSET %d;", table, keep)
+	if err := db.QueryRow(cmd).Scan(&ts); errors.Is(err, sql.ErrNoRows) {
+		return cutoff, cutoff > 0
+	} else if err != nil {
+		slog.Error("Unable to query", "table", table, "cmd", cmd, "err", err)
+		return cutoff, cutoff > 0
+	}
+	// the rows of ts are deleted too
+	cutoff = max(cutoff, ts+1e-6)
+	return cutoff, true
+}
+
+// retentionBound returns the ts before which the rows of the table are
+// no longer needed by the dispatching items reading it
+func retentionBound(table string, items []Item) float64 {
+	bound := float64(time.Now().Unix())
+	for _, item := range items {
+		if item.src != table {
+			continue
+		}
+		t, ok := browsed(item.dst)
+		if !ok {
+			return 0
+		}
+		bound = min(bound, float64(t))
+		if item.src_delete != "yes" {
+			// a late datapoint consolidates its bucket again from the source
+			bound = min(bound, float64(item.bucket.floor(time.Now().Add(-time.Duration(lateTolerance.Load())).Unix())))
+		}
+	}
+	return bound
+}
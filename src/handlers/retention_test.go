@@ -0,0 +1,101 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetentionCutoff(t *testing.T) {
+	const mb = 1024 * 1024
+	now := float64(time.Now().Unix())
+	tests := []struct {
+		name   string
+		policy RetentionPolicy
+		stats  []driver.Value // estimated rows and size
+		count  int64          // exact rows, when read
+		ts     []driver.Value // ts of the newest row to delete
+		offset string         // rows kept, "" when not read
+		cutoff float64
+		found  bool
+	}{
+		{"age", RetentionPolicy{maxAge: 3600}, nil, 0, nil, "", now - 3600, true},
+		{"few rows", RetentionPolicy{maxRows: 1000}, []driver.Value{int64(400), int64(mb)}, 0, nil, "", 0, false},
+		{"rows under", RetentionPolicy{maxRows: 1000}, []driver.Value{int64(900), int64(mb)}, 950, nil, "", 0, false},
+		{"rows over", RetentionPolicy{maxRows: 1000}, []driver.Value{int64(900), int64(mb)}, 1500, []driver.Value{12345.5}, "1000", 12345.5 + 1e-6, true},
+		{"size", RetentionPolicy{maxSize: mb}, []driver.Value{int64(1000), int64(4 * mb)}, 0, []driver.Value{12345.0}, "250", 12345 + 1e-6, true},
+		{"size under", RetentionPolicy{maxSize: mb}, []driver.Value{int64(1000), int64(mb / 2)}, 0, nil, "", 0, false},
+		{"strictest", RetentionPolicy{maxRows: 1000, maxSize: mb}, []driver.Value{int64(900), int64(4 * mb)}, 1500, []driver.Value{12345.0}, "375", 12345 + 1e-6, true},
+		{"age stricter", RetentionPolicy{maxAge: 3600, maxRows: 1000}, []driver.Value{int64(900), int64(mb)}, 1500, []driver.Value{12345.0}, "1000", now - 3600, true},
+		{"no row", RetentionPolicy{maxRows: 1000}, []driver.Value{int64(900), int64(mb)}, 1500, nil, "1000", 0, false},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		if tt.stats != nil {
+			f.on(`FROM information_schema\.tables`, fakeReply{cols: []string{"rows", "size"}, rows: [][]driver.Value{tt.stats}})
+		}
+		f.on(`^SELECT COUNT\(\*\) FROM measurements_t;$`, fakeReply{cols: []string{"n"}, rows: [][]driver.Value{{tt.count}}})
+		var rows [][]driver.Value
+		if tt.ts != nil {
+			rows = append(rows, tt.ts)
+		}
+		f.on(`ORDER BY ts DESC`, fakeReply{cols: []string{"ts"}, rows: rows})
+
+		// the age cutoffs move with the clock
+		tolerance := 1e-9
+		if tt.policy.maxAge > 0 {
+			tolerance = 2
+		}
+		cutoff, found := db.retentionCutoff("measurements_t", tt.policy)
+		if found != tt.found || math.Abs(cutoff-tt.cutoff) > tolerance {
+			t.Errorf("%s: cutoff %v, %v, want %v, %v", tt.name, cutoff, found, tt.cutoff, tt.found)
+		}
+		var offset string
+		if q := f.executed(`ORDER BY ts DESC`); len(q) > 0 {
+			_, offset, _ = strings.Cut(strings.TrimSuffix(q[0].query, ";"), "OFFSET ")
+		}
+		if offset != tt.offset {
+			t.Errorf("%s: %q rows kept, want %q", tt.name, offset, tt.offset)
+		}
+	}
+}
+
+func TestApplyRetentionRoundsUp(t *testing.T) {
+	defer SetDeletePolicy("10000", 0, false)
+	SetDeletePolicy("0", 0, false)
+
+	// the newest row beyond the count is in the middle of its second
+	f, db := newFakeDB(t)
+	f.on(`table_name LIKE \?`, fakeReply{cols: []string{"table_name"}, rows: [][]driver.Value{{"measurements_t"}}})
+	f.on(`FROM information_schema\.tables`, fakeReply{cols: []string{"rows", "size"}, rows: [][]driver.Value{{int64(2000), int64(1024)}}})
+	f.on(`^SELECT COUNT\(\*\) FROM measurements_t;$`, fakeReply{cols: []string{"n"}, rows: [][]driver.Value{{int64(2000)}}})
+	f.on(`ORDER BY ts DESC`, fakeReply{cols: []string{"ts"}, rows: [][]driver.Value{{12345.5}}})
+
+	if !db.ApplyRetention(context.Background(), []RetentionPolicy{{pattern: "measurements_%", maxRows: 1000}}, nil) {
+		t.Fatal("retention failed")
+	}
+	deletes := f.executed(`^DELETE FROM measurements_t\b`)
+	if want := "DELETE FROM measurements_t WHERE ts >= 0 AND ts < 12346;"; len(deletes) != 1 || deletes[0].query != want {
+		t.Errorf("deletes %v, want %q", deletes, want)
+	}
+}
@@ -0,0 +1,635 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Rule is a row of the dispatching table with its aggregates, as
+// exported in YAML:
+//
+//	rules:
+//	  - rank: 1
+//	    src_table: measurements_power
+//	    dst_table: power_5m
+//	    period: 300
+//	    retention: 720
+//	    filter:
+//	      places: ["outdoor*"]
+//	    aggregates:
+//	      - func: avg
+//	      - func: integralh
+//	        column: energy
+//
+// A disabled rule is not consolidated, its period is 0
+type Rule struct {
+	Rank       int64       `yaml:"rank"`
+	Source     string      `yaml:"src_table"`
+	SrcDelete  bool        `yaml:"src_delete,omitempty"`
+	Dest       string      `yaml:"dst_table"`
+	Period     int64       `yaml:"period"`
+	Disabled   bool        `yaml:"disabled,omitempty"`
+	Unit       string      `yaml:"unit,omitempty"`
+	Timezone   string      `yaml:"timezone,omitempty"`
+	Retention  int64       `yaml:"retention,omitempty"`
+	Schedule   string      `yaml:"schedule,omitempty"`
+	Filter     *Filter     `yaml:"filter,omitempty"`
+	Aggregates []Aggregate `yaml:"aggregates"`
+}
+
+type ruleFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// aggregateSpec is func, func(field) or func(field) as column
+var aggregateSpec = regexp.MustCompile(`^(\w+)(?:\((\w*)\))?(?:\s+as\s+(\w+))?$`)
+
+// ParseAggregates parses a comma separated list of aggregates:
+// "avg, max(value) as peak, integralh as energy"
+func ParseAggregates(spec string) ([]Aggregate, error) {
+	var result []Aggregate
+	for _, s := range strings.Split(spec, ",") {
+		m := aggregateSpec.FindStringSubmatch(strings.TrimSpace(s))
+		if m == nil {
+			return nil, fmt.Errorf("bad aggregate %q", s)
+		}
+		result = append(result, Aggregate{Func: strings.ToLower(m[1]), Field: m[2], Column: m[3]})
+	}
+	return result, nil
+}
+
+// item converts the rule, retention in hours, to a dispatching item
+func (r Rule) item() (Item, error) {
+	item := Item{
+		src:       r.Source,
+		dst:       r.Dest,
+		aggr:      r.Aggregates,
+		period:    r.Period,
+		unit:      strings.TrimSpace(r.Unit),
+		timezone:  strings.TrimSpace(r.Timezone),
+		retention: r.Retention * 3600,
+		schedule:  strings.TrimSpace(r.Schedule),
+		filter:    r.Filter,
+	}
+	if r.SrcDelete {
+		item.src_delete = "yes"
+	}
+	if item.filter.empty() {
+		item.filter = nil
+	}
+	if err := item.filter.validate(); err != nil {
+		return item, fmt.Errorf("%s: %w", r.Dest, err)
+	}
+	var err error
+	if item.bucket, err = newBucketer(item.period, item.unit, item.timezone); err != nil {
+		return item, fmt.Errorf("%s: %w", r.Dest, err)
+	}
+	if item.schedule != "" {
+		if item.cron, err = parseCron(item.schedule); err != nil {
+			return item, fmt.Errorf("%s: %w", r.Dest, err)
+		}
+	}
+	return item, nil
+}
+
+// validateRules returns the valid items, in topological order, and the
+// errors of the other rules
+func validateRules(rules []Rule) ([]Item, []error) {
+	var errs []error
+	var items []Item
+	ranks := make(map[int64]string)
+	for _, r := range rules {
+		if other, dup := ranks[r.Rank]; dup {
+			errs = append(errs, fmt.Errorf("%s: rank %d already used by %s", r.Dest, r.Rank, other))
+		} else {
+			ranks[r.Rank] = r.Dest
+		}
+		item, err := r.item()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		items = append(items, item)
+	}
+	items, graphErrs := orderItems(items)
+	return items, append(errs, graphErrs...)
+}
+
+func (db *DB) ReadRules() ([]Rule, error) {
+	cmdTemplate := `
+	SELECT rank, src_table, src_delete, dst_table, period, unit, timezone, retention, schedule, sensor_filter FROM %s ORDER BY rank;
+	`
+	cmd := fmt.Sprintf(cmdTemplate, dispatchTable)
+	rows, err := db.Query(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Rule
+	for rows.Next() {
+		var r Rule
+		var srcDelete, filter string
+		err := rows.Scan(&r.Rank,
+			&r.Source,
+			&srcDelete,
+			&r.Dest,
+			&r.Period,
+			&r.Unit,
+			&r.Timezone,
+			&r.Retention,
+			&r.Schedule,
+			&filter)
+		if err != nil {
+			slog.Error("Unable to fetch", "table", dispatchTable, "err", err)
+			continue
+		}
+		if r.Filter, err = ParseFilter(filter); err != nil {
+			slog.Error("Unable to fetch", "table", dispatchTable, "dst_table", r.Dest, "err", err)
+			continue
+		}
+		r.SrcDelete = srcDelete == "yes"
+		r.Disabled = r.Period == 0
+		result = append(result, r)
+	}
+	rows.Close()
+
+	aggr, err := db.ReadAggregatesTable()
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		result[i].Aggregates = aggr[result[i].Dest]
+	}
+	return result, nil
+}
+
+// WriteRules inserts the rules in a transaction, replacing the existing
+// rules of the same destination tables, or all the existing ones when
+// replace is set
+func (db *DB) WriteRules(rules []Rule, replace bool) bool {
+	tx, ok := db.BeginTransaction(context.Background())
+	if !ok {
+		return false
+	}
+	defer tx.RollbackTransaction()
+
+	if replace {
+		for _, table := range []string{dispatchTable, aggregatesTable} {
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s;", table)); err != nil {
+				slog.Error("Delete error", "table", table, "err", err)
+				return false
+			}
+		}
+	}
+
+	ruleTemplate := `
+	INSERT INTO %s (rank, src_table, src_delete, dst_table, period, unit, timezone, retention, schedule, sensor_filter)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+	aggrTemplate := `
+	INSERT INTO %s (dst_table, ord, func, field, name) values (?, ?, ?, ?, ?);
+	`
+	for _, r := range rules {
+		for _, table := range []string{dispatchTable, aggregatesTable} {
+			if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE dst_table = ?;", table), r.Dest); err != nil {
+				slog.Error("Delete error", "table", table, "err", err)
+				return false
+			}
+		}
+		srcDelete := "no"
+		if r.SrcDelete {
+			srcDelete = "yes"
+		}
+		if _, err := tx.Exec(fmt.Sprintf(ruleTemplate, dispatchTable), r.Rank, r.Source, srcDelete, r.Dest, r.Period, r.Unit, r.Timezone, r.Retention, r.Schedule, r.Filter.String()); err != nil {
+			slog.Error("Insert error", "table", dispatchTable, "dst_table", r.Dest, "err", err)
+			return false
+		}
+		for i, a := range r.Aggregates {
+			if _, err := tx.Exec(fmt.Sprintf(aggrTemplate, aggregatesTable), r.Dest, i+1, a.Func, a.Field, a.Column); err != nil {
+				slog.Error("Insert error", "table", aggregatesTable, "dst_table", r.Dest, "err", err)
+				return false
+			}
+		}
+	}
+	return tx.CommitTransaction()
+}
+
+// DeleteRule deletes the rule and its aggregates, the destination table
+// is kept
+func (db *DB) DeleteRule(dst string) bool {
+	tx, ok := db.BeginTransaction(context.Background())
+	if !ok {
+		return false
+	}
+	defer tx.RollbackTransaction()
+
+	for _, table := range []string{dispatchTable, aggregatesTable} {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE dst_table = ?;", table), dst); err != nil {
+			slog.Error("Delete error", "table", table, "err", err)
+			return false
+		}
+	}
+	return tx.CommitTransaction()
+}
+
+// openRules opens the database and returns the current rules
+func openRules() (*DB, []Rule, bool) {
+	db := newDB()
+	if db == nil {
+		return nil, nil, false
+	}
+	if _, ok := db.ReadOrCreateDispatchingTable(); !ok {
+		db.Close()
+		return nil, nil, false
+	}
+	rules, err := db.ReadRules()
+	if err != nil {
+		slog.Error("Unable to query", "table", dispatchTable, "err", err)
+		db.Close()
+		return nil, nil, false
+	}
+	return db, rules, true
+}
+
+// checkRules logs the errors of the rules. A rule without period has to
+// be disabled explicitly, a disabled rule is checked as the enabled ones
+// except for its period, which is borrowed from its source
+func checkRules(rules []Rule) bool {
+	// the disabled rules are not consolidated
+	enabled := slices.DeleteFunc(slices.Clone(rules), func(r Rule) bool { return r.Period == 0 })
+	_, errs := validateRules(enabled)
+	reported := make(map[string]bool)
+	for _, err := range errs {
+		reported[err.Error()] = true
+	}
+
+	probes := slices.Clone(enabled)
+	for _, r := range rules {
+		switch {
+		case r.Disabled && r.Period != 0:
+			errs = append(errs, fmt.Errorf("%s: disabled rule with a period", r.Dest))
+		case !r.Disabled && r.Period == 0:
+			errs = append(errs, fmt.Errorf("%s: no period, the rule has to be disabled explicitly", r.Dest))
+		case r.Disabled:
+			if _, err := newBucketer(1, strings.TrimSpace(r.Unit), strings.TrimSpace(r.Timezone)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", r.Dest, err))
+				continue
+			}
+			r.Period, r.Unit, r.Timezone = borrowedPeriod(rules, r)
+			probes = append(probes, r)
+		}
+	}
+	// the enabled rules reading a disabled one are already rejected
+	_, probeErrs := validateRules(probes)
+	for _, err := range probeErrs {
+		if !reported[err.Error()] {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, err := range errs {
+		slog.Error("Invalid rule", "err", err)
+	}
+	return len(errs) == 0
+}
+
+// borrowedPeriod returns the period of the first enabled rule up the
+// sources of a disabled rule, any period aligns on it, or 1 second
+func borrowedPeriod(rules []Rule, r Rule) (int64, string, string) {
+	for range rules {
+		idx := slices.IndexFunc(rules, func(s Rule) bool { return s.Dest == r.Source })
+		if idx < 0 {
+			break
+		}
+		if r = rules[idx]; r.Period != 0 {
+			return r.Period, r.Unit, r.Timezone
+		}
+	}
+	return 1, "", ""
+}
+
+// CheckRuleFile tells whether the rules of the file are valid, without
+// the database
+func CheckRuleFile(filename string) bool {
+	rules, ok := readRuleFile(filename)
+	return ok && checkRules(rules)
+}
+
+func readRuleFile(filename string) ([]Rule, bool) {
+	buff, err := os.ReadFile(filename)
+	if err != nil {
+		slog.Error("Rules", "filename", filename, "error", err)
+		return nil, false
+	}
+	var rf ruleFile
+	if err := yaml.Unmarshal(buff, &rf); err != nil {
+		slog.Error("Rules", "filename", filename, "error", err)
+		return nil, false
+	}
+	for _, r := range rf.Rules {
+		for i := range r.Aggregates {
+			r.Aggregates[i].Func = strings.ToLower(r.Aggregates[i].Func)
+		}
+	}
+	return rf.Rules, true
+}
+
+// RulesList prints the rules
+func RulesList(w io.Writer) bool {
+	db, rules, ok := openRules()
+	if !ok {
+		return false
+	}
+	defer db.Close()
+
+	fmt.Fprintf(w, "%-5s %-30s %-30s %-16s %-10s %-10s %s\n", "rank", "src_table", "dst_table", "period", "retention", "delete", "aggregates")
+	for _, r := range rules {
+		item, _ := r.item()
+		period := fmt.Sprint(r.Period)
+		if r.Disabled {
+			period = "disabled"
+		} else if item.bucket != nil {
+			period = item.bucket.String()
+		}
+		aggr := item.aggrString()
+		if r.Filter != nil {
+			aggr += " filter " + r.Filter.String()
+		}
+		fmt.Fprintf(w, "%-5d %-30s %-30s %-16s %-10s %-10v %s\n", r.Rank, r.Source, r.Dest, period, fmt.Sprintf("%dh", r.Retention), r.SrcDelete, aggr)
+	}
+	return true
+}
+
+// RulesAdd adds a rule, the whole set of rules has to stay valid
+func RulesAdd(rule Rule) bool {
+	db, rules, ok := openRules()
+	if !ok {
+		return false
+	}
+	defer db.Close()
+
+	if !checkRules(append(rules, rule)) || !db.checkPatterns([]Rule{rule}) || !db.WriteRules([]Rule{rule}, false) {
+		return false
+	}
+	slog.Info("Rule added", "dst_table", rule.Dest)
+	return true
+}
+
+// RulesRemove removes a rule, unless other rules read its table
+func RulesRemove(dst string) bool {
+	db, rules, ok := openRules()
+	if !ok {
+		return false
+	}
+	defer db.Close()
+
+	idx := slices.IndexFunc(rules, func(r Rule) bool { return r.Dest == dst })
+	if idx < 0 {
+		slog.Error("Unknown rule", "dst_table", dst)
+		return false
+	}
+	if !checkRules(slices.Delete(rules, idx, idx+1)) || !db.DeleteRule(dst) {
+		return false
+	}
+	slog.Info("Rule removed", "dst_table", dst)
+	return true
+}
+
+// RulesValidate checks the rules of the file, or of the database when
+// filename is empty, and that the measurement tables they read exist
+func RulesValidate(filename string) bool {
+	var db *DB
+	var rules []Rule
+	if filename != "" {
+		var ok bool
+		if rules, ok = readRuleFile(filename); !ok {
+			return false
+		}
+		if db = newDB(); db == nil {
+			return false
+		}
+	} else {
+		var ok bool
+		if db, rules, ok = openRules(); !ok {
+			return false
+		}
+	}
+	defer db.Close()
+	if !checkRules(rules) || !db.checkPatterns(rules) || !db.checkSources(rules) {
+		return false
+	}
+	slog.Info("Rules valid", "count", len(rules))
+	return true
+}
+
+// checkSources logs the rules reading a measurement table missing in the
+// database, orderItems accepting any
+func (db *DB) checkSources(rules []Rule) bool {
+	cmdTemplate := `
+	SELECT COUNT(*) FROM information_schema.tables
+	WHERE table_schema = DATABASE() AND table_name = ?;
+	`
+	measurements := strings.TrimSuffix(measurementTmpl, "%s")
+	found := make(map[string]bool)
+	ok := true
+	for _, r := range rules {
+		if !strings.HasPrefix(r.Source, measurements) || slices.ContainsFunc(rules, func(s Rule) bool { return s.Dest == r.Source }) {
+			continue
+		}
+		exists, known := found[r.Source]
+		if !known {
+			var n int
+			if err := db.QueryRow(cmdTemplate, r.Source).Scan(&n); err != nil {
+				slog.Error("Unable to query", "table", r.Source, "cmd", cmdTemplate, "err", err)
+				return false
+			}
+			exists = n > 0
+			found[r.Source] = exists
+		}
+		if !exists {
+			slog.Error("Invalid rule", "err", fmt.Errorf("%s: missing source table %s", r.Dest, r.Source))
+			ok = false
+		}
+	}
+	return ok
+}
+
+// RulesExport writes the rules in YAML
+func RulesExport(w io.Writer) bool {
+	db, rules, ok := openRules()
+	if !ok {
+		return false
+	}
+	defer db.Close()
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(ruleFile{Rules: rules}); err != nil {
+		slog.Error("Rules", "error", err)
+		return false
+	}
+	return enc.Close() == nil
+}
+
+// RulesImport replaces all the rules by the rules of the YAML file
+func RulesImport(filename string, dryRun bool) bool {
+	rules, ok := readRuleFile(filename)
+	if !ok || !checkRules(rules) {
+		return false
+	}
+	db, _, ok := openRules()
+	if !ok {
+		return false
+	}
+	defer db.Close()
+
+	if !db.checkPatterns(rules) {
+		return false
+	}
+	if dryRun {
+		slog.Info("Rules valid, nothing imported", "count", len(rules))
+		return true
+	}
+	if !db.WriteRules(rules, true) {
+		return false
+	}
+	slog.Info("Rules imported", "count", len(rules))
+	return true
+}
+
+// normalAggregates clears the fields and columns set to their default,
+// tiered telling whether the source is a consolidated table
+func normalAggregates(aggr []Aggregate, tiered bool) []Aggregate {
+	field := func(a Aggregate) string {
+		if tiered {
+			return "v" + a.Func
+		}
+		return defaultCol
+	}
+	result := slices.Clone(aggr)
+	for i, a := range result {
+		if a.Field == field(a) {
+			result[i].Field = ""
+		}
+		if a.Column == "v"+a.Func {
+			result[i].Column = ""
+		}
+	}
+	return result
+}
+
+// ruleDiff lists the fields differing between two rules, tiered telling
+// whether their source is a consolidated table
+func ruleDiff(a Rule, b Rule, tiered bool) []string {
+	var diff []string
+	fields := []struct {
+		name string
+		a, b any
+	}{
+		{"rank", a.Rank, b.Rank},
+		{"src_table", a.Source, b.Source},
+		{"src_delete", a.SrcDelete, b.SrcDelete},
+		{"period", a.Period, b.Period},
+		{"unit", a.Unit, b.Unit},
+		{"timezone", a.Timezone, b.Timezone},
+		{"retention", a.Retention, b.Retention},
+		{"schedule", a.Schedule, b.Schedule},
+		{"filter", a.Filter.String(), b.Filter.String()},
+		{"aggregates", fmt.Sprint(normalAggregates(a.Aggregates, tiered)), fmt.Sprint(normalAggregates(b.Aggregates, tiered))},
+	}
+	for _, f := range fields {
+		if f.a != f.b {
+			diff = append(diff, f.name)
+		}
+	}
+	return diff
+}
+
+// ReconcileRules makes the database rules match the rules of the YAML
+// file: the missing rules are created, the changed ones are updated when
+// apply is set and reported otherwise, the rules missing in the file are
+// reported and kept
+func ReconcileRules(filename string, apply bool) bool {
+	want, ok := readRuleFile(filename)
+	if !ok || !checkRules(want) {
+		return false
+	}
+	db, have, ok := openRules()
+	if !ok {
+		return false
+	}
+	defer db.Close()
+
+	consolidatedBy := func(table string) bool {
+		return slices.ContainsFunc(want, func(r Rule) bool { return r.Dest == table })
+	}
+	var changes []Rule
+	var created []bool
+	var diffs [][]string
+	result := slices.Clone(have)
+	for _, r := range want {
+		idx := slices.IndexFunc(have, func(h Rule) bool { return h.Dest == r.Dest })
+		if idx < 0 {
+			changes = append(changes, r)
+			created = append(created, true)
+			diffs = append(diffs, nil)
+			result = append(result, r)
+			continue
+		}
+		if diff := ruleDiff(have[idx], r, consolidatedBy(r.Source)); len(diff) > 0 {
+			if !apply {
+				slog.Warn("Rule drift", "dst_table", r.Dest, "fields", diff)
+				continue
+			}
+			changes = append(changes, r)
+			created = append(created, false)
+			diffs = append(diffs, diff)
+			result[idx] = r
+		}
+	}
+	for _, h := range have {
+		if !slices.ContainsFunc(want, func(r Rule) bool { return r.Dest == h.Dest }) {
+			slog.Warn("Rule not in file", "dst_table", h.Dest, "filename", filename)
+		}
+	}
+
+	if len(changes) == 0 {
+		return true
+	}
+	if !checkRules(result) || !db.checkPatterns(changes) || !db.WriteRules(changes, false) {
+		return false
+	}
+	for i, r := range changes {
+		if created[i] {
+			slog.Info("Rule created", "dst_table", r.Dest)
+		} else {
+			slog.Info("Rule updated", "dst_table", r.Dest, "fields", diffs[i])
+		}
+	}
+	RefreshRules()
+	return true
+}
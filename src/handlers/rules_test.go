@@ -0,0 +1,191 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseAggregates(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []Aggregate
+		err  bool
+	}{
+		{"avg", []Aggregate{{Func: "avg"}}, false},
+		{"AVG, max(value) as peak, integralh as energy", []Aggregate{
+			{Func: "avg"},
+			{Func: "max", Field: "value", Column: "peak"},
+			{Func: "integralh", Column: "energy"},
+		}, false},
+		{"min()", []Aggregate{{Func: "min"}}, false},
+		{"", nil, true},
+		{"avg,", nil, true},
+		{"max(value", nil, true},
+		{"max as", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAggregates(tt.spec)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseAggregates(%q) error %v, want error %v", tt.spec, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseAggregates(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestRuleDiff(t *testing.T) {
+	base := Rule{
+		Rank:       1,
+		Source:     "measurements_t",
+		Dest:       "t_hourly",
+		Period:     3600,
+		Aggregates: []Aggregate{{Func: "avg"}, {Func: "max", Column: "peak"}},
+	}
+	with := func(change func(r *Rule)) Rule {
+		r := base
+		r.Aggregates = slices.Clone(base.Aggregates)
+		change(&r)
+		return r
+	}
+	tests := []struct {
+		name   string
+		rule   Rule
+		tiered bool
+		want   []string
+	}{
+		{"same", with(func(r *Rule) {}), false, nil},
+		{"default field", with(func(r *Rule) { r.Aggregates[0].Field = "value" }), false, nil},
+		{"default column", with(func(r *Rule) { r.Aggregates[0].Column = "vavg" }), false, nil},
+		{"tiered default field", with(func(r *Rule) { r.Aggregates[0].Field = "vavg" }), true, nil},
+		{"raw field on tiered", with(func(r *Rule) { r.Aggregates[0].Field = "value" }), true, []string{"aggregates"}},
+		{"other field", with(func(r *Rule) { r.Aggregates[0].Field = "vavg" }), false, []string{"aggregates"}},
+		{"other column", with(func(r *Rule) { r.Aggregates[1].Column = "vmax" }), false, []string{"aggregates"}},
+		{"period and retention", with(func(r *Rule) { r.Period, r.Retention = 1800, 24 }), false, []string{"period", "retention"}},
+		{"filter", with(func(r *Rule) { r.Filter = &Filter{Places: []string{"garage"}} }), false, []string{"filter"}},
+		{"empty filter", with(func(r *Rule) { r.Filter = &Filter{} }), false, nil},
+	}
+	for _, tt := range tests {
+		if got := ruleDiff(base, tt.rule, tt.tiered); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: ruleDiff = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func disabledRule(rank int64, src string, dst string, unit string, funcs ...string) Rule {
+	r := testRule(rank, src, dst, 0, unit, funcs...)
+	r.Disabled = true
+	return r
+}
+
+func TestCheckRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  bool
+	}{
+		{"valid", []Rule{
+			testRule(1, "measurements_t", "a", 3600, "", "avg"),
+			testRule(2, "a", "b", 86400, "", "avg"),
+		}, true},
+		{"disabled rule", []Rule{
+			testRule(1, "measurements_t", "a", 3600, "", "avg"),
+			disabledRule(2, "a", "b", "day", "avg"),
+			disabledRule(3, "b", "c", "", "avg"),
+		}, true},
+		{"not disabled explicitly", []Rule{
+			testRule(1, "measurements_t", "a", 3600, "", "avg"),
+			testRule(2, "a", "b", 0, "", "avg"),
+		}, false},
+		{"disabled with a period", []Rule{
+			func() Rule { r := testRule(1, "measurements_t", "a", 3600, "", "avg"); r.Disabled = true; return r }(),
+		}, false},
+		{"disabled, missing source", []Rule{
+			disabledRule(1, "nowhere", "a", "", "avg"),
+		}, false},
+		{"disabled, unknown aggregate", []Rule{
+			disabledRule(1, "measurements_t", "a", "", "nosuch"),
+		}, false},
+		{"disabled, unknown unit", []Rule{
+			disabledRule(1, "measurements_t", "a", "fortnight", "avg"),
+		}, false},
+		{"disabled, duplicate rank", []Rule{
+			testRule(1, "measurements_t", "a", 3600, "", "avg"),
+			disabledRule(1, "measurements_t", "b", "", "avg"),
+		}, false},
+		{"disabled source", []Rule{
+			disabledRule(1, "measurements_t", "a", "", "avg"),
+			testRule(2, "a", "b", 86400, "", "avg"),
+		}, false},
+		{"invalid rule", []Rule{
+			testRule(1, "measurements_t", "a", 3600, "", "nosuch"),
+		}, false},
+		{"duplicate rank", []Rule{
+			testRule(1, "measurements_t", "a", 3600, "", "avg"),
+			testRule(1, "measurements_t", "b", 3600, "", "avg"),
+		}, false},
+	}
+	for _, tt := range tests {
+		rules := slices.Clone(tt.rules)
+		if got := checkRules(rules); got != tt.want {
+			t.Errorf("%s: checkRules = %v, want %v", tt.name, got, tt.want)
+		}
+		if !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("%s: checkRules changed the rules", tt.name)
+		}
+	}
+}
+
+func TestCheckSources(t *testing.T) {
+	rules := []Rule{
+		testRule(1, "measurements_t", "a", 3600, "", "avg"),
+		testRule(2, "a", "b", 86400, "", "avg"),
+		disabledRule(3, "measurements_h", "c", "", "avg"),
+		testRule(4, "measurements_t", "d", 3600, "", "max"),
+	}
+	tests := []struct {
+		name   string
+		exists []int64
+		want   bool
+	}{
+		{"all found", []int64{1, 1}, true},
+		{"missing table", []int64{1, 0}, false},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		for _, n := range tt.exists {
+			f.on(`information_schema\.tables`, fakeReply{cols: []string{"n"}, rows: [][]driver.Value{{n}}, times: 1})
+		}
+		if got := db.checkSources(rules); got != tt.want {
+			t.Errorf("%s: checkSources = %v, want %v", tt.name, got, tt.want)
+		}
+		// the tables of the rules are not looked up, the others once
+		var tables []string
+		for _, c := range f.executed(`information_schema\.tables`) {
+			tables = append(tables, c.args[0].(string))
+		}
+		if want := []string{"measurements_t", "measurements_h"}; !slices.Equal(tables, want) {
+			t.Errorf("%s: tables looked up %v, want %v", tt.name, tables, want)
+		}
+	}
+}
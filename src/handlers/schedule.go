@@ -0,0 +1,231 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Each dispatching item runs at the end of its period plus the grace
+// delay, or when its cron expression matches. Every item runs once at
+// startup to catch up with the periods elapsed while stopped
+var (
+	grace       atomic.Int64
+	itemTimeout atomic.Int64
+)
+
+func init() {
+	grace.Store(int64(40 * time.Second))
+}
+
+// SetConsolidationGrace changes the delay between the end of a period
+// and its consolidation, left to the late datapoints
+func SetConsolidationGrace(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("bad consolidation grace %s", d)
+	}
+	grace.Store(int64(d))
+	return nil
+}
+
+func getGrace() time.Duration {
+	return time.Duration(grace.Load())
+}
+
+// SetConsolidationTimeout limits the duration of the consolidation of
+// each dispatching item, 0 for no limit
+func SetConsolidationTimeout(d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("bad consolidation timeout %s", d)
+	}
+	itemTimeout.Store(int64(d))
+	return nil
+}
+
+func getItemTimeout() time.Duration {
+	return time.Duration(itemTimeout.Load())
+}
+
+// cronSchedule is a 5 fields cron expression: minute, hour, day of the
+// month, month and day of the week, in local time
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: 5 fields expected", expr)
+	}
+	c := &cronSchedule{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %w", expr, err)
+		}
+		*sets[i] = set
+	}
+	// sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField accepts *, n, n-m, each followed by an optional /step,
+// separated by commas
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+			rng, step = r, n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("bad value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("value out of range %q", part)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first minute matching the expression after t
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return limit
+}
+
+// nextRun returns the time of the next consolidation of the item after
+// now, the end of the current period plus the grace delay by default
+func (item *Item) nextRun(now time.Time) time.Time {
+	if item.cron != nil {
+		return item.cron.next(now)
+	}
+	g := getGrace()
+	return time.Unix(item.bucket.next(now.Add(-g).Unix()), 0).Add(g)
+}
+
+// scheduler keeps the next run of the dispatching items
+type scheduler struct {
+	items     []Item
+	next      map[string]time.Time
+	schedules map[string]string
+	refreshed time.Time
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{next: make(map[string]time.Time), schedules: make(map[string]string)}
+}
+
+// refresh replaces the items, the new ones and the ones whose schedule
+// changed are due at once
+func (s *scheduler) refresh(items []Item, now time.Time) {
+	s.items = items
+	for _, item := range items {
+		key := fmt.Sprintf("%s %s", item.bucket, item.schedule)
+		if _, ok := s.next[item.dst]; !ok || s.schedules[item.dst] != key {
+			s.next[item.dst] = now
+			s.schedules[item.dst] = key
+		}
+	}
+}
+
+// due returns the items to consolidate now, in rank order, and plans
+// their next run
+func (s *scheduler) due(now time.Time) []Item {
+	var result []Item
+	for _, item := range s.items {
+		if !s.next[item.dst].After(now) {
+			result = append(result, item)
+			s.next[item.dst] = item.nextRun(now)
+			slog.Debug("Scheduled", "dst_table", item.dst, "next", s.next[item.dst])
+		}
+	}
+	return result
+}
+
+// wait returns the time until the next due item, at most until the next
+// refresh of the dispatching table
+func (s *scheduler) wait(now time.Time, interval time.Duration) time.Duration {
+	at := s.refreshed.Add(interval)
+	for _, item := range s.items {
+		if s.next[item.dst].Before(at) {
+			at = s.next[item.dst]
+		}
+	}
+	return max(at.Sub(now), 0)
+}
@@ -0,0 +1,147 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"1,,2 * * * *",
+	}
+	for _, expr := range tests {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) accepted", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(y int, m time.Month, d int, h int, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+	// 2025-10-18 is a saturday
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", at(2025, 10, 18, 10, 7).Add(30 * time.Second), at(2025, 10, 18, 10, 8)},
+		{"*/15 * * * *", at(2025, 10, 18, 10, 7), at(2025, 10, 18, 10, 15)},
+		{"5/20 * * * *", at(2025, 10, 18, 10, 46), at(2025, 10, 18, 11, 5)},
+		{"0,30 8-9 * * *", at(2025, 10, 18, 9, 30), at(2025, 10, 19, 8, 0)},
+		{"0 3 * * *", at(2025, 10, 18, 3, 0), at(2025, 10, 19, 3, 0)},
+		{"30 2 1 * *", at(2025, 10, 18, 0, 0), at(2025, 11, 1, 2, 30)},
+		{"0 0 * * 1", at(2025, 10, 18, 0, 0), at(2025, 10, 20, 0, 0)},
+		{"0 0 * * 7", at(2025, 10, 18, 0, 0), at(2025, 10, 19, 0, 0)},
+		{"0 0 * * 0", at(2025, 10, 18, 0, 0), at(2025, 10, 19, 0, 0)},
+		{"0 0 13 * 5", at(2025, 10, 18, 0, 0), at(2025, 10, 24, 0, 0)},
+		{"0 0 1 1 *", at(2025, 10, 18, 0, 0), at(2026, 1, 1, 0, 0)},
+		{"0 12 29 2 *", at(2025, 10, 18, 0, 0), at(2028, 2, 29, 12, 0)},
+		{"0 0 31 2 *", at(2025, 10, 18, 0, 0), at(2030, 10, 18, 0, 1)},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := c.next(tt.from); !got.Equal(tt.want) {
+			t.Errorf("cron %q next(%s) = %s, want %s", tt.expr, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestNextRun(t *testing.T) {
+	SetConsolidationGrace(40 * time.Second)
+	defer SetConsolidationGrace(40 * time.Second)
+
+	cron, err := parseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		item Item
+		now  int64
+		want int64
+	}{
+		{"within the grace", Item{bucket: secondsBucketer{300}}, 1220, 1240},
+		{"after the grace", Item{bucket: secondsBucketer{300}}, 1240, 1540},
+		{"before the grace", Item{bucket: secondsBucketer{300}}, 1199, 1240},
+		{"cron", Item{bucket: secondsBucketer{300}, cron: cron}, 1220, 3600},
+	}
+	for _, tt := range tests {
+		if got := tt.item.nextRun(time.Unix(tt.now, 0)).Unix(); got != tt.want {
+			t.Errorf("%s: nextRun(%d) = %d, want %d", tt.name, tt.now, got, tt.want)
+		}
+	}
+}
+
+func TestSchedulerDue(t *testing.T) {
+	SetConsolidationGrace(0)
+	defer SetConsolidationGrace(40 * time.Second)
+
+	s := newScheduler()
+	items := []Item{
+		{dst: "a", bucket: secondsBucketer{60}},
+		{dst: "b", bucket: secondsBucketer{300}},
+	}
+	s.refresh(items, time.Unix(1000, 0))
+	tests := []struct {
+		now  int64
+		want []string
+	}{
+		{1000, []string{"a", "b"}},
+		{1010, nil},
+		{1020, []string{"a"}},
+		{1200, []string{"a", "b"}},
+		{1250, nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, item := range s.due(time.Unix(tt.now, 0)) {
+			got = append(got, item.dst)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("due(%d) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+
+	// a changed schedule is due at once
+	items[1].bucket = secondsBucketer{600}
+	s.refresh(items, time.Unix(1250, 0))
+	if got := s.due(time.Unix(1250, 0)); len(got) != 1 || got[0].dst != "b" {
+		t.Errorf("due after refresh = %v, want b", got)
+	}
+}
@@ -0,0 +1,270 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// With the sensor registry the measurement and consolidated tables refer
+// to the sensors by an integer key, their id, name and place being held
+// by the sensors table. The changes of name or place are recorded in the
+// sensor history with their validity interval, and the consolidation
+// groups the rows by key only, so that a renamed sensor keeps a single
+// history. The tables of the other layout are not converted, mqtt2sql
+// refuses to run while some exist
+type sensorInfo struct {
+	key         int64
+	name, place string
+	updated     float64 // ts of the registered name and place
+	// the change carried by the last datapoint, registered once confirmed
+	next *sensorChange
+}
+
+type sensorChange struct {
+	name, place string
+	ts          float64
+}
+
+const (
+	sensorsTable       = "sensors"
+	sensorHistoryTable = "sensor_history"
+	sensorKeyCol       = "sensor_key"
+)
+
+var (
+	registry   atomic.Bool
+	sensorsMu  sync.Mutex
+	sensorKeys = map[string]sensorInfo{}
+)
+
+// SetSensorRegistry selects the layout of the tables, by sensor key or
+// by sensor id, name and place
+func SetSensorRegistry(on bool) {
+	registry.Store(on)
+}
+
+// sensorColumns returns the columns identifying the sensor of a row of
+// the measurement and consolidated tables
+func sensorColumns() []string {
+	if registry.Load() {
+		return []string{sensorKeyCol}
+	}
+	return []string{"sensorid", "name", "place"}
+}
+
+// sensorColumnDefs returns the definitions of the sensor columns, the
+// ones following ts and the ones following the values
+func sensorColumnDefs() (string, string) {
+	if registry.Load() {
+		return sensorKeyCol + " INT UNSIGNED NOT NULL,", ""
+	}
+	return "sensorid TINYTEXT NOT NULL,", ",\n\t\tname TINYTEXT,\n\t\tplace TINYTEXT"
+}
+
+func (db *DB) CreateSensorTables() bool {
+	cmdTemplate := `
+	CREATE TABLE IF NOT EXISTS %s (
+		%s INT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		sensorid VARCHAR(255) NOT NULL UNIQUE,
+		name TINYTEXT,
+		place TINYTEXT,
+		updated DOUBLE NOT NULL
+	);
+	`
+	cmd := fmt.Sprintf(cmdTemplate, sensorsTable, sensorKeyCol)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to create", "table", sensorsTable, "cmd", cmd, "err", err)
+		return false
+	}
+
+	cmdTemplate = `
+	CREATE TABLE IF NOT EXISTS %s (
+		%s INT UNSIGNED NOT NULL,
+		name TINYTEXT,
+		place TINYTEXT,
+		valid_from DOUBLE NOT NULL,
+		valid_to DOUBLE
+	);
+	`
+	cmd = fmt.Sprintf(cmdTemplate, sensorHistoryTable, sensorKeyCol)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to create", "table", sensorHistoryTable, "cmd", cmd, "err", err)
+		return false
+	}
+
+	indexes := []Index{
+		Index{"idxhist_sensor_key_valid_from", "", sensorHistoryTable, sensorKeyCol + ", valid_from"},
+	}
+	return db.CreateIndexes(indexes)
+}
+
+// CheckSensorLayout tells whether the measurement and consolidated
+// tables, the ones with a ts column, identify their sensors as selected
+// by SetSensorRegistry
+func (db *DB) CheckSensorLayout() bool {
+	cmdTemplate := `
+	SELECT c.table_name FROM information_schema.columns c
+	JOIN information_schema.columns t ON t.table_schema = c.table_schema AND t.table_name = c.table_name AND t.column_name = 'ts'
+	WHERE c.table_schema = DATABASE() AND c.column_name = '%s'
+	ORDER BY c.table_name;
+	`
+	// the column of the other layout
+	other := sensorKeyCol
+	if registry.Load() {
+		other = "sensorid"
+	}
+	cmd := fmt.Sprintf(cmdTemplate, other)
+	rows, err := db.Query(cmd)
+	if err != nil {
+		slog.Error("Unable to query", "table", "information_schema.columns", "cmd", cmd, "err", err)
+		return false
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			slog.Error("Unable to fetch", "table", "information_schema.columns", "err", err)
+			return false
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("Unable to fetch", "table", "information_schema.columns", "err", err)
+		return false
+	}
+	if len(tables) > 0 {
+		slog.Error("Tables of the other sensor layout", "column", other, "sensor-registry", registry.Load(), "tables", strings.Join(tables, ", "))
+		return false
+	}
+	return true
+}
+
+// SensorKey returns the key of the sensor of the datapoint, registering
+// the sensor if needed. A new name or place is registered once the next
+// datapoint of the sensor carries it too, so that two publishers of
+// different tags do not rename the sensor at each message, and only if
+// newer than the last change, so that late or replayed datapoints do
+// not rename it back
+func (db *DB) SensorKey(dp *Datapoint) (int64, bool) {
+	change := sensorChange{dp.Tags.Name, dp.Tags.Place, float64(dp.Timestamp) / 1000.0}
+	sensorsMu.Lock()
+	info, ok := sensorKeys[dp.Tags.ID]
+	sensorsMu.Unlock()
+	if !ok {
+		if info, ok = db.registerSensorRetry(dp.Tags.ID, change, false); !ok {
+			return 0, false
+		}
+	}
+
+	switch {
+	case info.name == change.name && info.place == change.place:
+		info.next = nil
+	case change.ts <= info.updated:
+		slog.Debug("Sensor change older than the registered one", "sensorid", dp.Tags.ID, "name", change.name, "place", change.place, "ts", change.ts)
+	case info.next == nil || info.next.name != change.name || info.next.place != change.place:
+		info.next = &change
+	default:
+		if info, ok = db.registerSensorRetry(dp.Tags.ID, *info.next, true); !ok {
+			return 0, false
+		}
+	}
+	sensorsMu.Lock()
+	sensorKeys[dp.Tags.ID] = info
+	sensorsMu.Unlock()
+	return info.key, true
+}
+
+func (db *DB) registerSensorRetry(id string, change sensorChange, rename bool) (sensorInfo, bool) {
+	info, err := db.registerSensor(id, change, rename)
+	if err != nil {
+		slog.Warn("Unable to register sensor", "sensorid", id, "err", err)
+		if !db.CreateSensorTables() {
+			return info, false
+		}
+		if info, err = db.registerSensor(id, change, rename); err != nil {
+			slog.Error("Unable to register sensor", "sensorid", id, "err", err)
+			return info, false
+		}
+	}
+	return info, true
+}
+
+// registerSensor inserts the sensor or returns its registered name and
+// place. With rename set, a change newer than the registered one is
+// registered, closing the validity of the previous name and place at the
+// ts of the change
+func (db *DB) registerSensor(id string, change sensorChange, rename bool) (sensorInfo, error) {
+	info := sensorInfo{name: change.name, place: change.place, updated: change.ts}
+
+	tx, err := db.DB.BeginTx(context.Background(), nil)
+	if err != nil {
+		return info, err
+	}
+	defer tx.Rollback()
+
+	var name, place sql.NullString
+	var updated float64
+	cmd := fmt.Sprintf("SELECT %s, name, place, updated FROM %s WHERE sensorid = ? FOR UPDATE;", sensorKeyCol, sensorsTable)
+	err = tx.QueryRow(cmd, id).Scan(&info.key, &name, &place, &updated)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		cmd = fmt.Sprintf("INSERT INTO %s (sensorid, name, place, updated) values (?, ?, ?, ?);", sensorsTable)
+		result, err := tx.Exec(cmd, id, info.name, info.place, change.ts)
+		if err != nil {
+			return info, err
+		}
+		if info.key, err = result.LastInsertId(); err != nil {
+			return info, err
+		}
+		slog.Info("Sensor registered", "sensorid", id, "key", info.key, "name", info.name, "place", info.place)
+	case err != nil:
+		return info, err
+	case name.String == info.name && place.String == info.place:
+		info.updated = updated
+		return info, tx.Commit()
+	case !rename || change.ts <= updated:
+		// the registered name and place stay, another instance may have changed them
+		info.name, info.place, info.updated = name.String, place.String, updated
+		return info, tx.Commit()
+	default:
+		cmd = fmt.Sprintf("UPDATE %s SET name = ?, place = ?, updated = ? WHERE %s = ?;", sensorsTable, sensorKeyCol)
+		if _, err := tx.Exec(cmd, info.name, info.place, change.ts, info.key); err != nil {
+			return info, err
+		}
+		cmd = fmt.Sprintf("UPDATE %s SET valid_to = ? WHERE %s = ? AND valid_to IS NULL;", sensorHistoryTable, sensorKeyCol)
+		if _, err := tx.Exec(cmd, change.ts, info.key); err != nil {
+			return info, err
+		}
+		slog.Info("Sensor renamed", "sensorid", id, "key", info.key, "name", info.name, "place", info.place, "previous name", name.String, "previous place", place.String)
+	}
+	cmd = fmt.Sprintf("INSERT INTO %s (%s, name, place, valid_from) values (?, ?, ?, ?);", sensorHistoryTable, sensorKeyCol)
+	if _, err := tx.Exec(cmd, info.key, info.name, info.place, change.ts); err != nil {
+		return info, err
+	}
+	return info, tx.Commit()
+}
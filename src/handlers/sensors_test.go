@@ -0,0 +1,84 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"testing"
+)
+
+func TestSensorKey(t *testing.T) {
+	type tags struct {
+		name string
+		ts   int64 // milliseconds
+	}
+	registered := [][]driver.Value{{int64(7), "t", "kitchen", 2000.0}}
+	tests := []struct {
+		name       string
+		registered [][]driver.Value
+		dps        []tags
+		key        int64
+		// the ts of the changes registered, valid_to of the previous
+		// name and valid_from of the new one
+		changes []driver.Value
+	}{
+		{"same tags", registered, []tags{{"t", 3000e3}, {"t", 3001e3}}, 7, nil},
+		{"renamed", registered, []tags{{"t2", 3000e3}, {"t2", 3001e3}, {"t2", 3002e3}}, 7, []driver.Value{3000.0}},
+		{"not confirmed", registered, []tags{{"t2", 3000e3}, {"t", 3001e3}, {"t2", 3002e3}}, 7, nil},
+		{"two publishers", registered, []tags{{"t2", 3000e3}, {"t3", 3001e3}, {"t2", 3002e3}, {"t3", 3003e3}}, 7, nil},
+		{"late datapoints", registered, []tags{{"t0", 1000e3}, {"t0", 1001e3}, {"t0", 2000e3}}, 7, nil},
+		{"replayed then live", registered, []tags{{"t0", 1000e3}, {"t2", 3000e3}, {"t2", 3001e3}}, 7, []driver.Value{3000.0}},
+		{"new sensor", nil, []tags{{"t", 3000e3}, {"t", 3001e3}}, 9, nil},
+	}
+	for _, tt := range tests {
+		sensorKeys = map[string]sensorInfo{}
+		f, db := newFakeDB(t)
+		f.on(`^SELECT sensor_key, name, place, updated FROM sensors WHERE sensorid = \? FOR UPDATE;$`, fakeReply{cols: []string{"sensor_key", "name", "place", "updated"}, rows: tt.registered})
+		f.on(`^INSERT INTO sensors\b`, fakeReply{lastID: 9, affected: 1})
+		for _, dp := range tt.dps {
+			d := Datapoint{Timestamp: dp.ts}
+			d.Tags.ID, d.Tags.Name, d.Tags.Place = "t12", dp.name, "kitchen"
+			if key, ok := db.SensorKey(&d); !ok || key != tt.key {
+				t.Errorf("%s: key %d, %v at %d, want %d", tt.name, key, ok, dp.ts, tt.key)
+			}
+		}
+
+		var updated, closed, opened []driver.Value
+		for _, c := range f.executed(`^UPDATE sensors SET`) {
+			updated = append(updated, c.args[2])
+		}
+		for _, c := range f.executed(`^UPDATE sensor_history SET valid_to`) {
+			closed = append(closed, c.args[0])
+		}
+		for _, c := range f.executed(`^INSERT INTO sensor_history\b`) {
+			opened = append(opened, c.args[3])
+		}
+		if !reflect.DeepEqual(updated, tt.changes) || !reflect.DeepEqual(closed, tt.changes) {
+			t.Errorf("%s: sensor updated at %v, previous name closed at %v, want %v", tt.name, updated, closed, tt.changes)
+		}
+		// a new sensor opens its first validity
+		if tt.registered == nil {
+			if want := []driver.Value{3000.0}; !reflect.DeepEqual(opened, want) {
+				t.Errorf("%s: validity opened at %v, want %v", tt.name, opened, want)
+			}
+		} else if !reflect.DeepEqual(opened, tt.changes) {
+			t.Errorf("%s: validity opened at %v, want %v", tt.name, opened, tt.changes)
+		}
+	}
+}
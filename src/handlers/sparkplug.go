@@ -0,0 +1,411 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"errors"
+	"google.golang.org/protobuf/encoding/protowire"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+)
+
+// Sparkplug B topics are spBv1.0/<group>/<type>/<node>[/<device>]
+const (
+	sparkplugNamespace = "spBv1.0"
+	statusMeasurement  = "sensor_status"
+	bdSeqMetric        = "bdSeq"
+)
+
+// Sparkplug B metric datatypes, see the Sparkplug specification
+const (
+	spInt8    = 1
+	spInt16   = 2
+	spInt32   = 3
+	spInt64   = 4
+	spUInt8   = 5
+	spUInt16  = 6
+	spUInt32  = 7
+	spUInt64  = 8
+	spFloat   = 9
+	spDouble  = 10
+	spBoolean = 11
+)
+
+type spMetric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64
+	datatype  uint32
+	isNull    bool
+	hasValue  bool
+	intValue  uint64
+	value     float64
+}
+
+type spPayload struct {
+	timestamp uint64
+	seq       uint64
+	hasSeq    bool
+	metrics   []spMetric
+}
+
+// spDefinition is what a birth certificate tells about a metric
+type spDefinition struct {
+	name     string
+	datatype uint32
+}
+
+type spEdge struct {
+	aliases map[uint64]spDefinition
+	types   map[string]uint32
+}
+
+type spNode struct {
+	spEdge
+	bdSeq   int64
+	seq     int64
+	devices map[string]*spEdge
+}
+
+type sparkplugDecoder struct {
+	nodes map[string]*spNode
+}
+
+func isSparkplugTopic(topic string) bool {
+	return strings.HasPrefix(topic, sparkplugNamespace+"/")
+}
+
+func newSparkplugDecoder() *sparkplugDecoder {
+	return &sparkplugDecoder{nodes: make(map[string]*spNode)}
+}
+
+func newSpEdge() spEdge {
+	return spEdge{aliases: make(map[uint64]spDefinition), types: make(map[string]uint32)}
+}
+
+// Decode returns the datapoints of a message, the metrics without
+// timestamp and the deaths are stamped with the time of reception
+func (sp *sparkplugDecoder) Decode(topic string, payload []byte, received time.Time) []Datapoint {
+	parts := strings.Split(topic, "/")
+	if len(parts) < 4 || len(parts) > 5 {
+		slog.Debug("Sparkplug topic ignored", "topic", topic)
+		return nil
+	}
+	group, mtype, nodeID, device := parts[1], parts[2], parts[3], ""
+	if len(parts) == 5 {
+		device = parts[4]
+	}
+
+	p, err := parseSparkplugPayload(payload)
+	if err != nil {
+		slog.Error("Sparkplug decode", "topic", topic, "error", err)
+		rejectedMessages.inc("sparkplug")
+		return nil
+	}
+	slog.Debug("Sparkplug received", "topic", topic, "seq", p.seq, "metrics", len(p.metrics))
+
+	key := group + "/" + nodeID
+	node := sp.nodes[key]
+	now := receivedMilli(received)
+	var result []Datapoint
+
+	switch mtype {
+	case "NBIRTH":
+		node = &spNode{spEdge: newSpEdge(), bdSeq: -1, seq: int64(p.seq), devices: make(map[string]*spEdge)}
+		sp.nodes[key] = node
+		node.learn(p.metrics)
+		for _, m := range p.metrics {
+			if m.name == bdSeqMetric && m.hasValue {
+				node.bdSeq = int64(m.intValue)
+			}
+		}
+		result = append(result, statusDatapoint(group, nodeID, "", true, p.timestampOr(now)))
+		result = append(result, node.datapoints(&node.spEdge, group, nodeID, "", p, now)...)
+		slog.Info("Sparkplug node online", "group", group, "node", nodeID, "bdSeq", node.bdSeq)
+	case "NDEATH":
+		if node == nil {
+			slog.Debug("Sparkplug death of unknown node", "group", group, "node", nodeID)
+			return nil
+		}
+		for _, m := range p.metrics {
+			if m.name == bdSeqMetric && m.hasValue && node.bdSeq >= 0 && int64(m.intValue) != node.bdSeq {
+				slog.Info("Sparkplug stale death certificate", "group", group, "node", nodeID, "bdSeq", m.intValue, "expected", node.bdSeq)
+				return nil
+			}
+		}
+		for dev := range node.devices {
+			result = append(result, statusDatapoint(group, nodeID, dev, false, now))
+		}
+		result = append(result, statusDatapoint(group, nodeID, "", false, now))
+		delete(sp.nodes, key)
+		slog.Info("Sparkplug node offline", "group", group, "node", nodeID)
+	case "DBIRTH", "DDEATH", "NDATA", "DDATA":
+		if node == nil {
+			slog.Warn("Sparkplug message before node birth", "topic", topic)
+			return nil
+		}
+		node.checkSeq(topic, p)
+		switch mtype {
+		case "DBIRTH":
+			edge := newSpEdge()
+			node.devices[device] = &edge
+			edge.learn(p.metrics)
+			result = append(result, statusDatapoint(group, nodeID, device, true, p.timestampOr(now)))
+			result = append(result, node.datapoints(&edge, group, nodeID, device, p, now)...)
+			slog.Info("Sparkplug device online", "group", group, "node", nodeID, "device", device)
+		case "DDEATH":
+			delete(node.devices, device)
+			result = append(result, statusDatapoint(group, nodeID, device, false, now))
+			slog.Info("Sparkplug device offline", "group", group, "node", nodeID, "device", device)
+		case "NDATA":
+			result = node.datapoints(&node.spEdge, group, nodeID, "", p, now)
+		case "DDATA":
+			edge, ok := node.devices[device]
+			if !ok {
+				slog.Warn("Sparkplug data before device birth", "topic", topic)
+				return nil
+			}
+			result = node.datapoints(edge, group, nodeID, device, p, now)
+		}
+	default:
+		slog.Debug("Sparkplug message ignored", "topic", topic)
+	}
+
+	return result
+}
+
+func (n *spNode) checkSeq(topic string, p *spPayload) {
+	if !p.hasSeq {
+		return
+	}
+	if expected := (n.seq + 1) % 256; int64(p.seq) != expected {
+		slog.Warn("Sparkplug sequence gap", "topic", topic, "seq", p.seq, "expected", expected)
+	}
+	n.seq = int64(p.seq)
+}
+
+func (e *spEdge) learn(metrics []spMetric) {
+	for _, m := range metrics {
+		if m.name == "" {
+			continue
+		}
+		e.types[m.name] = m.datatype
+		if m.hasAlias {
+			e.aliases[m.alias] = spDefinition{name: m.name, datatype: m.datatype}
+		}
+	}
+}
+
+// datapoints turns the metrics of a payload into datapoints, the
+// aliases are resolved with the birth certificate of the device first
+// and then with the one of the node
+func (n *spNode) datapoints(e *spEdge, group, nodeID, device string, p *spPayload, now int64) []Datapoint {
+	var result []Datapoint
+	for _, m := range p.metrics {
+		name, datatype := m.name, m.datatype
+		if name == "" && m.hasAlias {
+			def, ok := e.aliases[m.alias]
+			if !ok {
+				def, ok = n.aliases[m.alias]
+			}
+			if !ok {
+				slog.Warn("Sparkplug unknown alias", "group", group, "node", nodeID, "device", device, "alias", m.alias)
+				continue
+			}
+			name, datatype = def.name, def.datatype
+		} else if datatype == 0 {
+			datatype = e.types[name]
+		}
+		if name == bdSeqMetric || strings.HasPrefix(name, "Node Control/") || strings.HasPrefix(name, "Device Control/") {
+			continue
+		}
+		value, ok := m.float(datatype)
+		if !ok {
+			slog.Debug("Sparkplug metric ignored", "name", name, "datatype", datatype)
+			continue
+		}
+		dp := Datapoint{Measurement: measurementName(name)}
+		dp.Fields.Value = value
+		dp.Tags.ID = edgePath(group, nodeID, device)
+		dp.Tags.Name = name
+		dp.Tags.Place = group
+		dp.Timestamp = int64(m.timestamp)
+		if dp.Timestamp == 0 {
+			dp.Timestamp = p.timestampOr(now)
+		}
+		result = append(result, dp)
+	}
+	return result
+}
+
+func (m *spMetric) float(datatype uint32) (float64, bool) {
+	if m.isNull || !m.hasValue {
+		return 0, false
+	}
+	switch datatype {
+	case spInt8, spInt16, spInt32:
+		return float64(int32(uint32(m.intValue))), true
+	case spInt64:
+		return float64(int64(m.intValue)), true
+	case spUInt8, spUInt16, spUInt32, spUInt64:
+		return float64(m.intValue), true
+	case spFloat, spDouble:
+		return m.value, true
+	case spBoolean:
+		return float64(m.intValue), true
+	case 0:
+		// no birth certificate seen for this metric, trust the wire type
+		return m.value, true
+	}
+	return 0, false
+}
+
+func (p *spPayload) timestampOr(now int64) int64 {
+	if p.timestamp > 0 {
+		return int64(p.timestamp)
+	}
+	return now
+}
+
+func statusDatapoint(group, nodeID, device string, online bool, ts int64) Datapoint {
+	dp := Datapoint{Measurement: statusMeasurement, Timestamp: ts}
+	if online {
+		dp.Fields.Value = 1
+	}
+	dp.Tags.ID = edgePath(group, nodeID, device)
+	dp.Tags.Name = nodeID
+	if device != "" {
+		dp.Tags.Name = device
+	}
+	dp.Tags.Place = group
+	return dp
+}
+
+func edgePath(group, nodeID, device string) string {
+	if device == "" {
+		return group + "/" + nodeID
+	}
+	return group + "/" + nodeID + "/" + device
+}
+
+// measurementName makes a table suffix out of a metric name,
+// "Inputs/Temperature 1" becomes "inputs_temperature_1"
+func measurementName(name string) string {
+	var b strings.Builder
+	sep := false
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if sep && b.Len() > 0 {
+				b.WriteByte('_')
+			}
+			b.WriteRune(r)
+			sep = false
+		} else {
+			sep = true
+		}
+	}
+	return b.String()
+}
+
+var errSparkplugPayload = errors.New("malformed Sparkplug B payload")
+
+func parseSparkplugPayload(b []byte) (*spPayload, error) {
+	p := &spPayload{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errSparkplugPayload
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.timestamp, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var v []byte
+			if v, n = protowire.ConsumeBytes(b); n >= 0 {
+				m, err := parseSparkplugMetric(v)
+				if err != nil {
+					return nil, err
+				}
+				p.metrics = append(p.metrics, *m)
+			}
+		case num == 3 && typ == protowire.VarintType:
+			p.seq, n = protowire.ConsumeVarint(b)
+			p.hasSeq = true
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, errSparkplugPayload
+		}
+		b = b[n:]
+	}
+	return p, nil
+}
+
+func parseSparkplugMetric(b []byte) (*spMetric, error) {
+	m := &spMetric{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, errSparkplugPayload
+		}
+		b = b[n:]
+		var v uint64
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var s []byte
+			s, n = protowire.ConsumeBytes(b)
+			m.name = string(s)
+		case num == 2 && typ == protowire.VarintType:
+			m.alias, n = protowire.ConsumeVarint(b)
+			m.hasAlias = true
+		case num == 3 && typ == protowire.VarintType:
+			m.timestamp, n = protowire.ConsumeVarint(b)
+		case num == 4 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.datatype = uint32(v)
+		case num == 7 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.isNull = v != 0
+		case (num == 10 || num == 11 || num == 14) && typ == protowire.VarintType:
+			m.intValue, n = protowire.ConsumeVarint(b)
+			m.value = float64(m.intValue)
+			m.hasValue = true
+		case num == 12 && typ == protowire.Fixed32Type:
+			var f uint32
+			f, n = protowire.ConsumeFixed32(b)
+			m.value = float64(math.Float32frombits(f))
+			m.hasValue = true
+		case num == 13 && typ == protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+			m.value = math.Float64frombits(v)
+			m.hasValue = true
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, errSparkplugPayload
+		}
+		b = b[n:]
+	}
+	return m, nil
+}
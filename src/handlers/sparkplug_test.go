@@ -0,0 +1,258 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testMetric is encoded as a Sparkplug B metric, the zero fields are
+// left out
+type testMetric struct {
+	name      string
+	alias     uint64
+	timestamp uint64
+	datatype  uint32
+	isNull    bool
+	intValue  uint64
+	float     float32
+	double    float64
+}
+
+func (m testMetric) encode() []byte {
+	var b []byte
+	if m.name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+	}
+	if m.alias != 0 {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.alias)
+	}
+	if m.timestamp != 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.timestamp)
+	}
+	if m.datatype != 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.datatype))
+	}
+	if m.isNull {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	switch {
+	case m.float != 0:
+		b = protowire.AppendTag(b, 12, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(m.float))
+	case m.double != 0:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(m.double))
+	case !m.isNull:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.intValue)
+	}
+	return b
+}
+
+func testPayload(timestamp uint64, seq uint64, metrics ...testMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, timestamp)
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.encode())
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, seq)
+	// an unknown field is skipped
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendString(b, "uuid")
+	return b
+}
+
+func TestParseSparkplugPayload(t *testing.T) {
+	valid := testPayload(1000, 7,
+		testMetric{name: "Temperature", alias: 3, datatype: spDouble, double: 21.5},
+		testMetric{alias: 4, timestamp: 990, intValue: 42},
+		testMetric{name: "Missing", datatype: spFloat, isNull: true},
+		testMetric{name: "Ratio", datatype: spFloat, float: 0.5},
+	)
+	tests := []struct {
+		name    string
+		payload []byte
+		want    *spPayload
+	}{
+		{"empty", nil, &spPayload{}},
+		{"valid", valid, &spPayload{
+			timestamp: 1000,
+			seq:       7,
+			hasSeq:    true,
+			metrics: []spMetric{
+				{name: "Temperature", alias: 3, hasAlias: true, datatype: spDouble, hasValue: true, value: 21.5},
+				{alias: 4, hasAlias: true, timestamp: 990, hasValue: true, intValue: 42, value: 42},
+				{name: "Missing", datatype: spFloat, isNull: true},
+				{name: "Ratio", datatype: spFloat, hasValue: true, value: 0.5},
+			},
+		}},
+		{"truncated", valid[:len(valid)-3], nil},
+		{"bad tag", []byte{0x80}, nil},
+		{"bad metric", protowire.AppendBytes(protowire.AppendTag(nil, 2, protowire.BytesType), []byte{0x0a, 0x05}), nil},
+	}
+	for _, tt := range tests {
+		got, err := parseSparkplugPayload(tt.payload)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%s: parsed %+v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSpMetricFloat(t *testing.T) {
+	tests := []struct {
+		name     string
+		metric   spMetric
+		datatype uint32
+		want     float64
+		ok       bool
+	}{
+		{"int8 negative", spMetric{hasValue: true, intValue: uint64(uint32(0xffffffff))}, spInt8, -1, true},
+		{"int32", spMetric{hasValue: true, intValue: 123}, spInt32, 123, true},
+		{"int64 negative", spMetric{hasValue: true, intValue: math.MaxUint64}, spInt64, -1, true},
+		{"uint64", spMetric{hasValue: true, intValue: 1 << 40}, spUInt64, 1 << 40, true},
+		{"double", spMetric{hasValue: true, value: 2.25}, spDouble, 2.25, true},
+		{"boolean", spMetric{hasValue: true, intValue: 1, value: 1}, spBoolean, 1, true},
+		{"unknown type", spMetric{hasValue: true, value: 3}, 0, 3, true},
+		{"string", spMetric{hasValue: true}, 12, 0, false},
+		{"null", spMetric{isNull: true}, spDouble, 0, false},
+		{"no value", spMetric{}, spDouble, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := tt.metric.float(tt.datatype)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%s: float() = %v, %v, want %v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMeasurementName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Temperature", "temperature"},
+		{"Inputs/Temperature 1", "inputs_temperature_1"},
+		{"  leading and trailing  ", "leading_and_trailing"},
+		{"a--b__c", "a_b_c"},
+		{"Énergie", "nergie"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := measurementName(tt.name); got != tt.want {
+			t.Errorf("measurementName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSparkplugDecode(t *testing.T) {
+	type point struct {
+		measurement string
+		id          string
+		name        string
+		value       float64
+		ts          int64
+	}
+	tests := []struct {
+		topic   string
+		payload []byte
+		want    []point
+	}{
+		{"spBv1.0/plant/NDATA/edge1", testPayload(50, 0), nil},
+		{"spBv1.0/plant/NBIRTH/edge1", testPayload(100, 0,
+			testMetric{name: "bdSeq", datatype: spUInt64, intValue: 5},
+			testMetric{name: "Node Control/Rebirth", datatype: spBoolean},
+			testMetric{name: "Supply Voltage", alias: 1, datatype: spFloat, float: 12.5},
+		), []point{
+			{"sensor_status", "plant/edge1", "edge1", 1, 100},
+			{"supply_voltage", "plant/edge1", "Supply Voltage", 12.5, 100},
+		}},
+		{"spBv1.0/plant/DBIRTH/edge1/pump", testPayload(110, 1,
+			testMetric{name: "Flow", alias: 2, datatype: spInt16, intValue: uint64(uint32(0xfffffffe))},
+		), []point{
+			{"sensor_status", "plant/edge1/pump", "pump", 1, 110},
+			{"flow", "plant/edge1/pump", "Flow", -2, 110},
+		}},
+		{"spBv1.0/plant/DDATA/edge1/pump", testPayload(120, 2,
+			testMetric{alias: 2, intValue: 7},
+			testMetric{alias: 1, timestamp: 115, float: 12.25},
+			testMetric{alias: 9, intValue: 1},
+		), []point{
+			{"flow", "plant/edge1/pump", "Flow", 7, 120},
+			{"supply_voltage", "plant/edge1/pump", "Supply Voltage", 12.25, 115},
+		}},
+		{"spBv1.0/plant/DDATA/edge1/valve", testPayload(125, 3), nil},
+		{"spBv1.0/plant/NDEATH/edge1", testPayload(0, 0,
+			testMetric{name: "bdSeq", datatype: spUInt64, intValue: 4},
+		), nil},
+		{"spBv1.0/plant/NDATA/edge1", testPayload(130, 4,
+			testMetric{name: "Supply Voltage", float: 11.5},
+		), []point{
+			{"supply_voltage", "plant/edge1", "Supply Voltage", 11.5, 130},
+		}},
+		{"spBv1.0/plant/NDEATH/edge1", testPayload(0, 0,
+			testMetric{name: "bdSeq", datatype: spUInt64, intValue: 5},
+		), []point{
+			{"sensor_status", "plant/edge1/pump", "pump", 0, 1000},
+			{"sensor_status", "plant/edge1", "edge1", 0, 1000},
+		}},
+		{"spBv1.0/plant/NDATA/edge1", testPayload(140, 5,
+			testMetric{name: "Supply Voltage", float: 11.5},
+		), nil},
+		{"spBv1.0/plant/STATE", testPayload(150, 0), nil},
+		{"spBv1.0/plant/NDATA/edge1", []byte{0xff}, nil},
+	}
+
+	// the deaths are stamped with the time of reception
+	received := time.UnixMilli(1000)
+	sp := newSparkplugDecoder()
+	for i, tt := range tests {
+		var got []point
+		for _, dp := range sp.Decode(tt.topic, tt.payload, received) {
+			if dp.Tags.Place != "plant" {
+				t.Errorf("%d %s: place %q, want plant", i, tt.topic, dp.Tags.Place)
+			}
+			got = append(got, point{dp.Measurement, dp.Tags.ID, dp.Tags.Name, dp.Fields.Value, dp.Timestamp})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%d %s: got %v, want %v", i, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -18,12 +18,15 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	_ "github.com/go-sql-driver/mysql"
 	"log/slog"
 	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,12 +34,24 @@ type Item struct {
 	src        string
 	src_delete string
 	dst        string
-	aggr       []string
+	aggr       []Aggregate
+	names      []string
+	funcs      []string
+	cols       []string
+	tscols     []string
 	alist      string
+	tiered     bool
+	branch     int
 	clist      string
 	dlist      string
 	period     int64
+	unit       string
+	timezone   string
+	bucket     bucketer
 	retention  int64
+	schedule   string
+	cron       *cronSchedule
+	filter     *Filter
 }
 
 type Index struct {
@@ -46,66 +61,255 @@ type Index struct {
 	cols  string
 }
 
+// DB runs the statements in the transaction, if any, started by
+// BeginTransaction
 type DB struct {
 	*sql.DB
+	tx  *sql.Tx
+	ctx context.Context
 }
 
 const (
 	connString      = "ustd:m55PC2Qh@tcp(mariadb:3306)/mqtt2sql"
 	dispatchTable   = "dispatch"
+	aggregatesTable = "dispatch_aggregates"
 	defaultCol      = "value"
-	margeTemps      = 40
 	measurementTmpl = "measurements_%s"
+	statusTable     = "sensor_status"
 )
 
 var (
 	lastBrowsed  map[string]int64
+	browsedMu    sync.Mutex
 	measReceived map[string]int64
+	measMu       sync.Mutex
+	reinterval   = make(chan time.Duration, 1)
+	rerules      = make(chan struct{}, 1)
+	// everything received before flushedAt is inserted, the consolidation
+	// does not go beyond
+	flushedAt atomic.Int64
 )
 
+// SetConsolidationInterval changes the interval of the running SqlHandler
+func SetConsolidationInterval(d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("bad consolidation interval %s, expected a positive duration", d)
+	}
+	select {
+	case <-reinterval:
+	default:
+	}
+	reinterval <- d
+	return nil
+}
+
+// RefreshRules makes the running SqlHandler read the dispatching table
+// again at once
+func RefreshRules() {
+	select {
+	case rerules <- struct{}{}:
+	default:
+	}
+}
+
+// SqlBatchHandler prints the inserts of the datapoints, with the sensor
+// registry the sensors are inserted as needed but their history is not
+// recorded
 func SqlBatchHandler(ich <-chan Datapoint) {
 	cmdTemplate := "INSERT INTO %s (ts, sensorid, %s, name, place) values (%.3f, '%s', %v, '%s', '%s'); -- %v"
+	statusTemplate := "REPLACE INTO %s (sensorid, online, ts, name, place) values ('%s', %v, %.3f, '%s', '%s'); -- %v"
+	sensorTemplate := "INSERT IGNORE INTO %s (sensorid, name, place, updated) values ('%s', '%s', '%s', %.3f);"
+	keyTemplate := "INSERT INTO %s (ts, %s, %s) SELECT %.3f, %s, %v FROM %s WHERE sensorid = '%s'; -- %v"
+	registered := make(map[string]bool)
 
 	for dp := range ich {
+		if dp.Measurement == statusMeasurement {
+			cmd := fmt.Sprintf(statusTemplate, statusTable, dp.Tags.ID, dp.Fields.Value, float64(dp.Timestamp)/1000.0, dp.Tags.Name, dp.Tags.Place, time.UnixMilli(dp.Timestamp))
+			fmt.Println(cmd)
+			continue
+		}
 		table := fmt.Sprintf(measurementTmpl, dp.Measurement)
+		if registry.Load() {
+			if !registered[dp.Tags.ID] {
+				cmd := fmt.Sprintf(sensorTemplate, sensorsTable, dp.Tags.ID, dp.Tags.Name, dp.Tags.Place, float64(dp.Timestamp)/1000.0)
+				fmt.Println(cmd)
+				registered[dp.Tags.ID] = true
+			}
+			cmd := fmt.Sprintf(keyTemplate, table, sensorKeyCol, defaultCol, float64(dp.Timestamp)/1000.0, sensorKeyCol, dp.Fields.Value, sensorsTable, dp.Tags.ID, time.UnixMilli(dp.Timestamp))
+			fmt.Println(cmd)
+			continue
+		}
 		cmd := fmt.Sprintf(cmdTemplate, table, defaultCol, float64(dp.Timestamp)/1000.0, dp.Tags.ID, dp.Fields.Value, dp.Tags.Name, dp.Tags.Place, time.UnixMilli(dp.Timestamp))
 		fmt.Println(cmd)
 	}
 }
 
-func SqlHandler(ich <-chan Datapoint) {
+// SqlHandler inserts the datapoints while a consolidator, with its own
+// database connections, consolidates the data as scheduled. When the
+// context is done it stops consolidating and drains its input for at
+// most timeout, an unfinished consolidation is then rolled back
+func SqlHandler(ctx context.Context, ich <-chan Datapoint, interval time.Duration, timeout time.Duration) bool {
 
-	ticker := time.NewTicker(3 * time.Minute)
 	lastBrowsed = make(map[string]int64)
 	measReceived = make(map[string]int64)
 
 	db := newDB()
-	if db != nil {
-		defer db.Close()
-		// results not used, this is to create the table as early as possible
-		db.ReadOrCreateDispatchingTable()
-		for {
-			select {
-			case dp := <-ich:
-				slog.Debug(
-					"json parsed",
-					"measurement", dp.Measurement,
-					"ts", dp.Timestamp,
-					"id", dp.Tags.ID,
-					"name", dp.Tags.Name,
-					"place", dp.Tags.Place,
-					"value", dp.Fields.Value)
-				db.InsertMeasurement(&dp)
-			case t := <-ticker.C:
-				slog.Debug("Tick", "at", t)
-				if items, ok := db.ReadOrCreateDispatchingTable(); ok {
-					db.ConsolidateData(items)
+	if db == nil {
+		return false
+	}
+	defer db.Close()
+	cdb := newDB()
+	if cdb == nil {
+		return false
+	}
+	defer cdb.Close()
+	onScrape(func() {
+		for pool, db := range map[string]*DB{"ingest": db, "consolidate": cdb} {
+			st := db.Stats()
+			dbConnections.set(float64(st.InUse), pool, "in_use")
+			dbConnections.set(float64(st.Idle), pool, "idle")
+			dbWaits.set(float64(st.WaitCount), pool)
+			dbWaitTime.set(st.WaitDuration.Seconds(), pool)
+		}
+	})
+	lastInsert.Store(time.Now().UnixNano())
+	lastConsolidation.Store(time.Now().UnixNano())
+	flushedAt.Store(time.Now().UnixNano())
+	onReady("database", func(ctx context.Context, maxAge time.Duration) (bool, map[string]any) {
+		if err := db.PingContext(ctx); err != nil {
+			return false, map[string]any{"error": err.Error()}
+		}
+		return true, map[string]any{}
+	})
+	onReady("insert", activityCheck(&lastInsert))
+	onReady("consolidation", activityCheck(&lastConsolidation))
+
+	work, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+	stop := context.AfterFunc(ctx, func() {
+		slog.Info("Draining", "timeout", timeout.String())
+		time.AfterFunc(timeout, abort)
+	})
+	defer stop()
+
+	if !db.CheckSensorLayout() {
+		return false
+	}
+	// results not used, this is to create the table as early as possible
+	db.ReadOrCreateDispatchingTable()
+	if registry.Load() {
+		db.CreateSensorTables()
+	}
+
+	cctx, cstop := context.WithCancel(ctx)
+	defer cstop()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cdb.consolidator(cctx, work, interval)
+	}()
+
+	idle := time.NewTicker(time.Second)
+	defer idle.Stop()
+	for {
+		select {
+		case dp, ok := <-ich:
+			if !ok {
+				slog.Info("Input closed")
+				cstop()
+				select {
+				case <-done:
+					return true
+				case <-work.Done():
+					slog.Error("Drain timeout", "waiting", "consolidation")
+					return false
 				}
 			}
+			slog.Debug(
+				"json parsed",
+				"measurement", dp.Measurement,
+				"ts", dp.Timestamp,
+				"id", dp.Tags.ID,
+				"name", dp.Tags.Name,
+				"place", dp.Tags.Place,
+				"value", dp.Fields.Value)
+			if dp.Measurement == statusMeasurement {
+				db.UpdateSensorStatus(&dp)
+			} else if table := fmt.Sprintf(measurementTmpl, dp.Measurement); db.InsertMeasurement(&dp) {
+				insertsDone.inc(table)
+				lastInsert.Store(time.Now().UnixNano())
+			} else {
+				insertsFailed.inc(table)
+			}
+			if len(ich) == 0 {
+				flushedAt.Store(time.Now().UnixNano())
+			}
+		case <-idle.C:
+			if len(ich) == 0 {
+				flushedAt.Store(time.Now().UnixNano())
+			}
+		case <-work.Done():
+			slog.Error("Drain timeout", "pending", len(ich))
+			return false
 		}
 	}
+}
 
-	ticker.Stop()
+// consolidator runs the dispatching items when they are due until the
+// context is done, the consolidation running then goes on with work
+func (db *DB) consolidator(ctx context.Context, work context.Context, interval time.Duration) {
+	// the first run catches up at once
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	sched := newScheduler()
+	var policies []RetentionPolicy
+
+	for {
+		select {
+		case t := <-timer.C:
+			slog.Debug("Tick", "at", t)
+			refreshed, passed := false, true
+			if now := time.Now(); now.Sub(sched.refreshed) >= interval {
+				logQueueStats()
+				if items, ok := db.ReadOrCreateDispatchingTable(); ok {
+					sched.refresh(items, now)
+				} else {
+					passed = false
+				}
+				if p, ok := db.ReadOrCreateRetentionTable(); ok {
+					policies = p
+				}
+				sched.refreshed = now
+				refreshed = true
+			}
+			passed = db.ConsolidateLate(work, sched.items) && passed
+			if items := sched.due(time.Now()); len(items) > 0 {
+				passed = db.ConsolidateData(work, items) && passed
+			}
+			// a pass without due item counts too, the consolidation is
+			// then up to date
+			if passed {
+				lastConsolidation.Store(time.Now().UnixNano())
+			}
+			// the retention runs once per interval, after the consolidation
+			if refreshed {
+				db.MaintainPartitions(work, sched.items)
+			}
+			if refreshed && len(policies) > 0 {
+				db.ApplyRetention(work, policies, sched.items)
+			}
+			timer.Reset(sched.wait(time.Now(), interval))
+		case <-rerules:
+			sched.refreshed = time.Time{}
+			timer.Reset(0)
+		case d := <-reinterval:
+			interval = d
+			timer.Reset(sched.wait(time.Now(), interval))
+			slog.Info("Consolidation interval", "interval", d.String())
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 func newDB() *DB {
@@ -114,7 +318,7 @@ func newDB() *DB {
 		return nil
 	} else {
 		slog.Info("Database opened")
-		return &DB{db}
+		return &DB{DB: db}
 	}
 }
 
@@ -122,7 +326,7 @@ func (db *DB) ReadOrCreateDispatchingTable() ([]Item, bool) {
 	items, err := db.ReadDispatchingTable()
 	if err != nil {
 		slog.Warn("Unable to query", "table", dispatchTable, "err", err)
-		if db.CreateDispatchingTable() && db.CreateDispatchingIndex() {
+		if db.CreateDispatchingTable() && db.CreateDispatchingIndex() && db.CreateAggregatesTable() && db.MigrateDispatchingTable() {
 			if items, err = db.ReadDispatchingTable(); err != nil {
 				slog.Error("Unable to query", "table", dispatchTable, "err", err)
 				return nil, false
@@ -141,12 +345,12 @@ func (db *DB) CreateDispatchingTable() bool {
 		src_table TINYTEXT NOT NULL,
 		src_delete TINYTEXT NOT NULL,
 		dst_table TINYTEXT NOT NULL,
-		aggr1 TINYTEXT NOT NULL,
-		aggr2 TINYTEXT NOT NULL,
-		aggr3 TINYTEXT NOT NULL,
-		aggr4 TINYTEXT NOT NULL,
 		period INT UNSIGNED NOT NULL,
-		retention INT UNSIGNED NOT NULL
+		unit TINYTEXT NOT NULL DEFAULT '',
+		timezone TINYTEXT NOT NULL DEFAULT '',
+		retention INT UNSIGNED NOT NULL,
+		schedule TINYTEXT NOT NULL DEFAULT '',
+		sensor_filter TEXT NOT NULL DEFAULT ''
 	);
 	`
 	cmd := fmt.Sprintf(cmdTemplate, dispatchTable)
@@ -159,6 +363,96 @@ func (db *DB) CreateDispatchingTable() bool {
 	return true
 }
 
+// CreateAggregatesTable creates the table of the aggregates of the
+// dispatching items, in the order of the columns of the destination
+func (db *DB) CreateAggregatesTable() bool {
+	cmdTemplate := `
+	CREATE TABLE IF NOT EXISTS %s (
+		dst_table TINYTEXT NOT NULL,
+		ord INT UNSIGNED NOT NULL,
+		func TINYTEXT NOT NULL,
+		field TINYTEXT NOT NULL DEFAULT '',
+		name TINYTEXT NOT NULL DEFAULT ''
+	);
+	`
+	cmd := fmt.Sprintf(cmdTemplate, aggregatesTable)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to create", "table", aggregatesTable, "cmd", cmd, "err", err)
+		return false
+	}
+
+	slog.Info("Table created", "table", aggregatesTable)
+	indexes := []Index{
+		Index{"idxaggr_dst_table_ord", "UNIQUE", aggregatesTable, "dst_table, ord"},
+	}
+	return db.CreateIndexes(indexes)
+}
+
+// MigrateDispatchingTable adds the columns missing in a dispatching
+// table created by a previous version and copies the aggr1..aggr4
+// columns of the items without aggregates to the aggregates table, the
+// source field being the column of the same rank of the source item
+func (db *DB) MigrateDispatchingTable() bool {
+	cmdTemplate := `
+	ALTER TABLE %s
+	ADD COLUMN IF NOT EXISTS schedule TINYTEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS sensor_filter TEXT NOT NULL DEFAULT '' AFTER schedule,
+	ADD COLUMN IF NOT EXISTS unit TINYTEXT NOT NULL DEFAULT '' AFTER period,
+	ADD COLUMN IF NOT EXISTS timezone TINYTEXT NOT NULL DEFAULT '' AFTER unit;
+	`
+	cmd := fmt.Sprintf(cmdTemplate, dispatchTable)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to migrate", "table", dispatchTable, "cmd", cmd, "err", err)
+		return false
+	}
+
+	var legacy int
+	cmd = fmt.Sprintf(`
+	SELECT COUNT(*) FROM information_schema.columns
+	WHERE table_schema = DATABASE() AND table_name = '%s' AND column_name IN ('aggr1', 'aggr2', 'aggr3', 'aggr4');
+	`, dispatchTable)
+	if err := db.QueryRow(cmd).Scan(&legacy); err != nil {
+		slog.Error("Unable to query", "table", dispatchTable, "cmd", cmd, "err", err)
+		return false
+	}
+	if legacy < 4 {
+		return true
+	}
+
+	selectTemplate := `
+	SELECT d.dst_table, %d, d.aggr%d, IF(s.dst_table IS NULL, '%s', CONCAT('v', s.aggr%d)), CONCAT('v', d.aggr%d)
+	FROM %s d LEFT JOIN %s s ON s.dst_table = d.src_table
+	WHERE d.aggr%d <> '' AND d.dst_table NOT IN (SELECT dst_table FROM %s)
+	`
+	var selects []string
+	for i := 1; i <= 4; i++ {
+		selects = append(selects, fmt.Sprintf(selectTemplate, i, i, defaultCol, i, i, dispatchTable, dispatchTable, i, aggregatesTable))
+	}
+	// a single statement, so that the items already migrated are the same for all ranks
+	cmd = fmt.Sprintf("INSERT INTO %s (dst_table, ord, func, field, name) %s;", aggregatesTable, strings.Join(selects, " UNION ALL "))
+	result, err := db.Exec(cmd)
+	if err != nil {
+		slog.Error("Unable to migrate", "table", dispatchTable, "cmd", cmd, "err", err)
+		return false
+	}
+	migrated, _ := result.RowsAffected()
+	if migrated > 0 {
+		slog.Info("Aggregates migrated", "table", aggregatesTable, "rows", migrated)
+	}
+
+	// the legacy columns are kept but no longer needed in new rows
+	cmd = fmt.Sprintf(`
+	ALTER TABLE %s
+	MODIFY aggr1 TINYTEXT NOT NULL DEFAULT '', MODIFY aggr2 TINYTEXT NOT NULL DEFAULT '',
+	MODIFY aggr3 TINYTEXT NOT NULL DEFAULT '', MODIFY aggr4 TINYTEXT NOT NULL DEFAULT '';
+	`, dispatchTable)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to migrate", "table", dispatchTable, "cmd", cmd, "err", err)
+		return false
+	}
+	return true
+}
+
 func (db *DB) CreateDispatchingIndex() bool {
 	indexes := []Index{
 		Index{"idxdisp_rank", "UNIQUE", dispatchTable, "rank"},
@@ -167,38 +461,71 @@ func (db *DB) CreateDispatchingIndex() bool {
 	return db.CreateIndexes(indexes)
 }
 
-func (db *DB) ConsolidateData(items []Item) bool {
+// ConsolidateData runs the dispatching items, each one in its own
+// transaction, the independent branches of the graph in parallel. It
+// stops when the context is done
+func (db *DB) ConsolidateData(ctx context.Context, items []Item) bool {
 	now := time.Now()
+	branches := make(map[int][]Item)
+	for _, item := range items {
+		branches[item.branch] = append(branches[item.branch], item)
+	}
+
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for _, branch := range branches {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !db.consolidateBranch(ctx, now, branch) {
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	slog.Info("Consolidated", "now", now)
+	return !failed.Load()
+}
+
+// consolidateBranch runs the items of a branch in topological order
+func (db *DB) consolidateBranch(ctx context.Context, now time.Time, items []Item) bool {
+	failed := false
 	for _, item := range items {
+		if ctx.Err() != nil {
+			slog.Warn("Consolidation interrupted", "dst_table", item.dst)
+			return false
+		}
+		var t1 int64
 		if maxts, ok := db.ReadMaxTimestamp(item.dst); ok {
-			lastBrowsed[item.dst] = int64((int64(maxts)/item.period)+1) * item.period
-		} else {
-			lastBrowsed[item.dst] = 0
+			t1 = item.bucket.next(int64(maxts))
+		} else if mints, ok := db.ReadMinTimestamp(item.src); ok {
+			// the calendar buckets are consolidated one by one, from the first one
+			t1 = item.bucket.floor(int64(mints))
 		}
-		item.clist = mapNames(item.aggr, []string{}, "v%s")
-		item.dlist = mapNames(item.aggr, []string{}, "v%s DOUBLE NOT NULL")
-		idx := slices.IndexFunc(items, func(i Item) bool { return i.dst == item.src })
-		if idx >= 0 {
-			item.alist = mapNames(item.aggr, items[idx].aggr, "%%s(v%s)")
-		} else {
-			item.alist = mapNames(item.aggr, []string{defaultCol, defaultCol, defaultCol, defaultCol}, "%%s(%s)")
+		setBrowsed(item.dst, t1)
+		t2 := item.bucket.floor(now.Add(-getGrace()).Unix())
+		if w := item.bucket.floor(time.Unix(0, flushedAt.Load()).Unix()); w < t2 {
+			slog.Debug("Consolidation held back by ingestion", "dst_table", item.dst, "ts", t2, "flushed", w)
+			t2 = w
 		}
-		t2 := int64(int64((now.Unix()-margeTemps))/item.period) * item.period
-		t1 := lastBrowsed[item.dst]
+		prev := setConsolidated(item.src, t1)
 		slog.Debug(
 			"dispatching",
 			"src_table", item.src,
 			"src_delete", item.src_delete,
 			"dst_table", item.dst,
-			"aggr", strings.Join(item.aggr, ", "),
+			"aggr", item.aggrString(),
 			"alist", item.alist,
+			"funcs", strings.Join(item.funcs, ", "),
 			"clist", item.clist,
 			"dlist", item.dlist,
-			"period", item.period,
+			"period", item.bucket.String(),
 			"retention", item.retention,
+			"schedule", item.schedule,
 			"last_ts", t1,
 			"ts", t2)
-		if len(item.alist) == 0 || t2 <= t1 {
+		if len(item.names) == 0 || t2 <= t1 {
 			continue
 		}
 		slog.Info(
@@ -207,48 +534,126 @@ func (db *DB) ConsolidateData(items []Item) bool {
 			"src_delete", item.src_delete,
 			"dst_table", item.dst,
 			"alist", item.alist,
-			"period", item.period,
+			"period", item.bucket.String(),
 			"retention", item.retention,
 			"last_ts", t1,
 			"ts", t2,
-			"received", measReceived[item.src])
-		if db.BeginTransaction() {
-			if !db.InsertConsolidatedData(item, t1, t2) {
-				db.RollbackTransaction()
-				continue
-			}
-			if item.retention > 0 && t2 > item.retention {
-				if !db.DeleteData(item.dst, 0, t2-item.retention) {
-					db.RollbackTransaction()
-					continue
-				}
-			}
-			if item.src_delete == "yes" {
-				if !db.DeleteData(item.src, t1, t2) {
-					db.RollbackTransaction()
-					continue
-				}
-				measReceived[item.src] = 0
-			}
-			db.CommitTransaction()
+			"received", received(item.src))
+		start := time.Now()
+		// the datapoints inserted during the transaction are late ones
+		prev = max(prev, t1)
+		setConsolidated(item.src, t2)
+		if !db.ConsolidateItem(ctx, item, t1, t2) {
+			consolidationErrs.inc(item.dst)
+			resetConsolidated(item.src, prev, t2)
+			failed = true
+		} else {
+			setBrowsed(item.dst, t2)
 		}
+		consolidationTime.observe(time.Since(start).Seconds(), item.dst)
 	}
+	return !failed
+}
 
-	slog.Info("Consolidated", "now", now)
+// ConsolidateItem consolidates [t1, t2) in a transaction, applies the
+// retention and deletes the source data if needed, the transaction is
+// rolled back when the item timeout expires. With a deferred delete
+// policy the deletes run once the consolidated data is committed
+func (db *DB) ConsolidateItem(ctx context.Context, item Item, t1 int64, t2 int64) bool {
+	if d := getItemTimeout(); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	tx, ok := db.BeginTransaction(ctx)
+	if !ok {
+		return false
+	}
+	inserted, ok := tx.insertConsolidatedData(item, t1, t2)
+	if !ok {
+		tx.RollbackTransaction()
+		return false
+	}
+	if getDeletePolicy().deferred {
+		if !tx.CommitTransaction() {
+			return false
+		}
+		consolidatedRows.add(float64(inserted), item.dst)
+		// the data is consolidated, the deletes left undone are only reported
+		if !db.withContext(ctx).deleteConsolidated(item, t1, t2) {
+			slog.Warn("Deletes left undone after consolidation", "dst_table", item.dst, "src_table", item.src, "t1", t1, "t2", t2)
+		}
+		return true
+	}
+	if !tx.deleteConsolidated(item, t1, t2) {
+		tx.RollbackTransaction()
+		return false
+	}
+	if !tx.CommitTransaction() {
+		return false
+	}
+	consolidatedRows.add(float64(inserted), item.dst)
 	return true
 }
 
+// deleteConsolidated applies the retention of the item and deletes its
+// source data if needed
+func (db *DB) deleteConsolidated(item Item, t1 int64, t2 int64) bool {
+	// the partitions of a partitioned table are dropped by MaintainPartitions
+	if item.retention > 0 && t2 > item.retention && !isPartitioned(item.dst) {
+		if !db.DeleteData(item.dst, 0, t2-item.retention, nil) {
+			return false
+		}
+	}
+	if item.src_delete == "yes" {
+		// the last bucket is kept for the point carried into the next one
+		if item.carries() && t1 > 0 {
+			t1, t2 = item.bucket.floor(t1-1), item.bucket.floor(t2-1)
+		}
+		if !db.DeleteData(item.src, t1, t2, item.filter) {
+			return false
+		}
+		measMu.Lock()
+		measReceived[item.src] = 0
+		measMu.Unlock()
+	}
+	return true
+}
+
+// browsed returns the end of the consolidated data of a table, if known
+func browsed(table string) (int64, bool) {
+	browsedMu.Lock()
+	defer browsedMu.Unlock()
+	t, ok := lastBrowsed[table]
+	return t, ok
+}
+
+func setBrowsed(table string, t int64) {
+	browsedMu.Lock()
+	lastBrowsed[table] = t
+	browsedMu.Unlock()
+}
+
+func received(table string) int64 {
+	measMu.Lock()
+	defer measMu.Unlock()
+	return measReceived[table]
+}
+
 func (db *DB) CreateMeasurementTable(table string) bool {
 	cmdTemplate := `
 	CREATE TABLE IF NOT EXISTS %s (
-		ts DOUBLE NOT NULL,
-		sensorid TINYTEXT NOT NULL,
-		%s DOUBLE NOT NULL,
-		name TINYTEXT,
-		place TINYTEXT
-	);
+		ts %s NOT NULL,
+		%s
+		%s DOUBLE NOT NULL%s
+	)%s;
 	`
-	cmd := fmt.Sprintf(cmdTemplate, table, defaultCol)
+	tsType, partition := "DOUBLE", partitionClause("FLOOR(ts)")
+	if partition != "" {
+		tsType = "DECIMAL(16,3)"
+	}
+	head, tail := sensorColumnDefs()
+	cmd := fmt.Sprintf(cmdTemplate, table, tsType, head, defaultCol, tail, partition)
 	if _, err := db.Exec(cmd); err != nil {
 		slog.Error("Unable to create", "table", table, "cmd", cmd, "err", err)
 		return false
@@ -260,7 +665,7 @@ func (db *DB) CreateMeasurementTable(table string) bool {
 
 func (db *DB) CreateMeasurementIndex(table string) bool {
 	indexes := []Index{
-		Index{"idxmeas_ts_sensorid", "", table, "ts, sensorid"},
+		Index{"idxmeas_ts_" + sensorColumns()[0], "", table, "ts, " + sensorColumns()[0]},
 		Index{"idxmeas_ts", "", table, "ts"},
 	}
 	return db.CreateIndexes(indexes)
@@ -270,13 +675,14 @@ func (db *DB) CreateConsolidatedTable(item Item) bool {
 	cmdTemplate := `
 	CREATE TABLE IF NOT EXISTS %s (
 		ts INT NOT NULL,
-		sensorid TINYTEXT NOT NULL,
+		%s
 		%s,
-		name TINYTEXT,
-		place TINYTEXT
-	);
+		%s BIGINT NOT NULL DEFAULT 1%s
+	)%s;
 	`
-	cmd := fmt.Sprintf(cmdTemplate, item.dst, item.dlist)
+	partition := partitionClause("ts")
+	head, tail := sensorColumnDefs()
+	cmd := fmt.Sprintf(cmdTemplate, item.dst, head, item.dlist, countCol, tail, partition)
 	if _, err := db.Exec(cmd); err != nil {
 		slog.Error("Unable to create", "table", item.dst, "cmd", cmd, "err", err)
 		return false
@@ -286,57 +692,94 @@ func (db *DB) CreateConsolidatedTable(item Item) bool {
 	return true
 }
 
+// MigrateConsolidatedTable adds the count and the hidden columns to a
+// consolidated table created by a previous version, the existing rows
+// count for one and their hidden columns are 0, so that their first and
+// stddev values are kept as is by a merge
+func (db *DB) MigrateConsolidatedTable(table string, hidden []string) bool {
+	cmdTemplate := `
+	ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s BIGINT NOT NULL DEFAULT 1 AFTER %s%s;
+	`
+	var add string
+	for _, name := range hidden {
+		add += fmt.Sprintf(", ADD COLUMN IF NOT EXISTS %s DOUBLE NOT NULL DEFAULT 0", name)
+	}
+	cmd := fmt.Sprintf(cmdTemplate, table, countCol, sensorColumns()[0], add)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to migrate", "table", table, "cmd", cmd, "err", err)
+		return false
+	}
+	return true
+}
+
+// migrateConsolidatedTables migrates the destination and, when it is
+// consolidated too, the source of the item, whose hidden columns are
+// added by its own item
+func (db *DB) migrateConsolidatedTables(item Item) bool {
+	return db.MigrateConsolidatedTable(item.dst, item.hiddenNames()) && (!item.tiered || db.MigrateConsolidatedTable(item.src, nil))
+}
+
 func (db *DB) CreateConsolidatedIndex(table string) bool {
 	indexes := []Index{
-		Index{"idxcons_ts_sensorid_name_place", "UNIQUE", table, "ts, sensorid, name, place"},
+		Index{"idxcons_ts_" + strings.Join(sensorColumns(), "_"), "UNIQUE", table, "ts, " + strings.Join(sensorColumns(), ", ")},
 		Index{"idxcons_ts", "", table, "ts"},
 	}
 	return db.CreateIndexes(indexes)
 }
 
 func (db *DB) ReadDispatchingTable() ([]Item, error) {
+	rules, err := db.ReadRules()
+	if err != nil {
+		return nil, err
+	}
+	// the rules without period are disabled
+	rules = slices.DeleteFunc(rules, func(r Rule) bool { return r.Period == 0 })
+	items, errs := validateRules(rules)
+	for _, err := range errs {
+		slog.Error("Dispatching item rejected", "err", err)
+	}
+	return items, nil
+}
+
+// ReadAggregatesTable returns the aggregates by destination table
+func (db *DB) ReadAggregatesTable() (map[string][]Aggregate, error) {
 	cmdTemplate := `
-	SELECT src_table, src_delete, dst_table, aggr1, aggr2, aggr3, aggr4, period, retention FROM %s ORDER BY rank;
+	SELECT dst_table, func, field, name FROM %s ORDER BY dst_table, ord;
 	`
-	cmd := fmt.Sprintf(cmdTemplate, dispatchTable)
+	cmd := fmt.Sprintf(cmdTemplate, aggregatesTable)
 	rows, err := db.Query(cmd)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var result []Item
+	result := make(map[string][]Aggregate)
 	for rows.Next() {
-		item := Item{}
-		aggr := []string{"", "", "", ""}
-		err := rows.Scan(&item.src,
-			&item.src_delete,
-			&item.dst,
-			&aggr[0],
-			&aggr[1],
-			&aggr[2],
-			&aggr[3],
-			&item.period,
-			&item.retention)
-		item.aggr = aggr
-		if err != nil {
-			slog.Error("Unable to fetch", "table", dispatchTable, "err", err)
+		var dst string
+		var a Aggregate
+		if err := rows.Scan(&dst, &a.Func, &a.Field, &a.Column); err != nil {
+			slog.Error("Unable to fetch", "table", aggregatesTable, "err", err)
 			continue
 		}
-		if item.period > 0 {
-			item.retention *= 3600
-			result = append(result, item)
-		}
+		a.Func = strings.ToLower(strings.TrimSpace(a.Func))
+		result[dst] = append(result[dst], a)
 	}
-	rows.Close()
-
-	return result, nil
+	return result, rows.Err()
 }
 
 func (db *DB) ReadMaxTimestamp(table string) (float64, bool) {
+	return db.readTimestamp("max", table)
+}
+
+func (db *DB) ReadMinTimestamp(table string) (float64, bool) {
+	return db.readTimestamp("min", table)
+}
+
+func (db *DB) readTimestamp(fn string, table string) (float64, bool) {
 	cmdTemplate := `
-	SELECT max(ts) FROM %s;
+	SELECT %s(ts) FROM %s;
 	`
-	cmd := fmt.Sprintf(cmdTemplate, table)
+	cmd := fmt.Sprintf(cmdTemplate, fn, table)
 	rows, err := db.Query(cmd)
 	if err != nil {
 		return 0, false
@@ -364,8 +807,20 @@ func (db *DB) InsertMeasurement(dp *Datapoint) bool {
 	cmdTemplate := `
 	INSERT INTO %s (ts, sensorid, %s, name, place) values (?, ?, ?, ?, ?);
 	`
+	keyTemplate := `
+	INSERT INTO %s (ts, %s, %s) values (?, ?, ?);
+	`
 	table := fmt.Sprintf(measurementTmpl, dp.Measurement)
 	cmd := fmt.Sprintf(cmdTemplate, table, defaultCol)
+	args := []any{float64(dp.Timestamp) / 1000.0, dp.Tags.ID, dp.Fields.Value, dp.Tags.Name, dp.Tags.Place}
+	if registry.Load() {
+		key, ok := db.SensorKey(dp)
+		if !ok {
+			return false
+		}
+		cmd = fmt.Sprintf(keyTemplate, table, sensorKeyCol, defaultCol)
+		args = []any{float64(dp.Timestamp) / 1000.0, key, dp.Fields.Value}
+	}
 	stmt, err := db.Prepare(cmd)
 	if err != nil {
 		slog.Warn("Unable to prepare stmt", "table", table, "cmd", cmd, "err", err)
@@ -380,7 +835,7 @@ func (db *DB) InsertMeasurement(dp *Datapoint) bool {
 	}
 	defer stmt.Close()
 
-	result, err := stmt.Exec(float64(dp.Timestamp)/1000.0, dp.Tags.ID, dp.Fields.Value, dp.Tags.Name, dp.Tags.Place)
+	result, err := stmt.Exec(args...)
 	if err != nil {
 		slog.Error("Insert error", "table", table, "data", dp, "err", err)
 		return false
@@ -388,29 +843,47 @@ func (db *DB) InsertMeasurement(dp *Datapoint) bool {
 
 	affected, _ := result.RowsAffected()
 	slog.Debug("Inserted", "data", dp, "affected rows", affected)
+	measMu.Lock()
 	measReceived[table] += affected
+	measMu.Unlock()
+	// the consolidation sets the end of the consolidated data before its
+	// transaction, a datapoint it missed is late once inserted
+	checkLate(table, dp.Timestamp/1000)
 
 	return true
 }
 
-func (db *DB) InsertConsolidatedData(item Item, t1 int64, t2 int64) bool {
-
+func (db *DB) CreateStatusTable() bool {
 	cmdTemplate := `
-	INSERT INTO %s (ts, sensorid, %s, name, place)
-	SELECT FLOOR(ts/%d)*%d AS t, sensorid, %s, name, place
-	FROM %s
-	WHERE ts >= %d AND ts < %d
-	GROUP BY t, sensorid, name, place;
+	CREATE TABLE IF NOT EXISTS %s (
+		sensorid VARCHAR(255) NOT NULL PRIMARY KEY,
+		online TINYINT NOT NULL,
+		ts DOUBLE NOT NULL,
+		name TINYTEXT,
+		place TINYTEXT
+	);
 	`
+	cmd := fmt.Sprintf(cmdTemplate, statusTable)
+	if _, err := db.Exec(cmd); err != nil {
+		slog.Error("Unable to create", "table", statusTable, "cmd", cmd, "err", err)
+		return false
+	}
+
+	slog.Info("Table created", "table", statusTable)
+	return true
+}
 
-	cmd := fmt.Sprintf(cmdTemplate, item.dst, item.clist, item.period, item.period, item.alist, item.src, t1, t2)
-	slog.Debug("Consolidation", "cmd", cmd)
+func (db *DB) UpdateSensorStatus(dp *Datapoint) bool {
+	cmdTemplate := `
+	REPLACE INTO %s (sensorid, online, ts, name, place) values (?, ?, ?, ?, ?);
+	`
+	cmd := fmt.Sprintf(cmdTemplate, statusTable)
 	stmt, err := db.Prepare(cmd)
 	if err != nil {
-		slog.Warn("Unable to prepare stmt", "table", item.dst, "cmd", cmd, "err", err)
-		if db.CreateConsolidatedTable(item) && db.CreateConsolidatedIndex(item.dst) {
+		slog.Warn("Unable to prepare stmt", "table", statusTable, "cmd", cmd, "err", err)
+		if db.CreateStatusTable() {
 			if stmt, err = db.Prepare(cmd); err != nil {
-				slog.Error("Unable to prepare stmt", "table", item.dst, "cmd", cmd, "err", err)
+				slog.Error("Unable to prepare stmt", "table", statusTable, "cmd", cmd, "err", err)
 				return false
 			}
 		} else {
@@ -419,52 +892,96 @@ func (db *DB) InsertConsolidatedData(item Item, t1 int64, t2 int64) bool {
 	}
 	defer stmt.Close()
 
-	result, err2 := stmt.Exec()
-	if err2 != nil {
-		slog.Error("Insert error", "table", item.dst, "err", err2)
+	if _, err := stmt.Exec(dp.Tags.ID, dp.Fields.Value != 0, float64(dp.Timestamp)/1000.0, dp.Tags.Name, dp.Tags.Place); err != nil {
+		slog.Error("Insert error", "table", statusTable, "data", dp, "err", err)
 		return false
 	}
 
-	affected, _ := result.RowsAffected()
-	slog.Info("Inserted", "table", item.dst, "t1", t1, "t2", t2, "affected rows", affected)
-
+	slog.Debug("Status updated", "sensorid", dp.Tags.ID, "online", dp.Fields.Value != 0)
 	return true
 }
 
-func (db *DB) DeleteData(table string, t1 int64, t2 int64) bool {
+func (db *DB) InsertConsolidatedData(item Item, t1 int64, t2 int64) bool {
+	_, ok := db.insertConsolidatedData(item, t1, t2)
+	return ok
+}
+
+// insertConsolidatedData returns the count of the rows inserted, which
+// are only counted by the metrics once committed
+func (db *DB) insertConsolidatedData(item Item, t1 int64, t2 int64) (int64, bool) {
+	if item.alist == "" {
+		return db.insertComputedData(item, t1, t2)
+	}
+
 	cmdTemplate := `
-	DELETE FROM %s WHERE ts >= %d AND ts < %d;
+	INSERT INTO %s (ts, %s, %s, %s)
+	SELECT %s AS t, %s, %s, %s
+	FROM %s
+	WHERE ts >= %d AND ts < %d%s
+	GROUP BY t, %s%s;
 	`
-	cmd := fmt.Sprintf(cmdTemplate, table, t1, t2)
-	stmt, err := db.Prepare(cmd)
-	if err != nil {
-		slog.Error("Unable to prepare stmt", "table", table, "cmd", cmd, "err", err)
-		return false
-	}
-	defer stmt.Close()
+	filter, args := item.filter.where()
+	sensor := strings.Join(sensorColumns(), ", ")
 
-	result, err := stmt.Exec()
-	if err != nil {
-		slog.Error("Delete error", "table", table, "err", err)
-		return false
+	// the calendar buckets have no SQL expression, they are inserted one by one
+	type bucket struct {
+		expr   string
+		t1, t2 int64
+	}
+	var buckets []bucket
+	if b, ok := item.bucket.(secondsBucketer); ok {
+		buckets = append(buckets, bucket{fmt.Sprintf("FLOOR(ts/%d)*%d", b.period, b.period), t1, t2})
+	} else {
+		for t := t1; t < t2; t = item.bucket.next(t) {
+			buckets = append(buckets, bucket{fmt.Sprint(t), t, min(item.bucket.next(t), t2)})
+		}
 	}
 
-	affected, _ := result.RowsAffected()
-	slog.Info("Deleted", "table", table, "t1", t1, "t2", t2, "affected rows", affected)
+	var total int64
+	for i, b := range buckets {
+		cmd := fmt.Sprintf(cmdTemplate, item.dst, sensor, item.clist, countCol, b.expr, sensor, item.alist, item.countExpr(), item.src, b.t1, b.t2, filter, sensor, item.onDuplicate())
+		slog.Debug("Consolidation", "cmd", cmd, "args", args)
+		stmt, err := db.Prepare(cmd)
+		if err != nil && i == 0 {
+			slog.Warn("Unable to prepare stmt", "table", item.dst, "cmd", cmd, "err", err)
+			if db.CreateConsolidatedTable(item) && db.CreateConsolidatedIndex(item.dst) && db.migrateConsolidatedTables(item) {
+				stmt, err = db.Prepare(cmd)
+			} else {
+				return 0, false
+			}
+		}
+		if err != nil {
+			slog.Error("Unable to prepare stmt", "table", item.dst, "cmd", cmd, "err", err)
+			return 0, false
+		}
 
-	return true
+		result, err := stmt.ExecContext(db.execContext(), args...)
+		stmt.Close()
+		if err != nil {
+			slog.Error("Insert error", "table", item.dst, "err", err)
+			return 0, false
+		}
+		affected, _ := result.RowsAffected()
+		total += affected
+	}
+
+	slog.Info("Inserted", "table", item.dst, "t1", t1, "t2", t2, "affected rows", total)
+	return total, true
 }
 
-func (db *DB) BeginTransaction() bool {
-	if _, err := db.Exec("START TRANSACTION"); err != nil {
+// BeginTransaction returns a DB bound to a new transaction, the
+// transaction is rolled back if the context is done before the commit
+func (db *DB) BeginTransaction(ctx context.Context) (*DB, bool) {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
 		slog.Error("Unable to start a transaction", "err", err)
-		return false
+		return nil, false
 	}
-	return true
+	return &DB{DB: db.DB, tx: tx, ctx: ctx}, true
 }
 
 func (db *DB) CommitTransaction() bool {
-	if _, err := db.Exec("COMMIT"); err != nil {
+	if err := db.tx.Commit(); err != nil {
 		slog.Error("Unable to commit a transaction", "err", err)
 		return false
 	}
@@ -472,13 +989,42 @@ func (db *DB) CommitTransaction() bool {
 }
 
 func (db *DB) RollbackTransaction() bool {
-	if _, err := db.Exec("ROLLBACK"); err != nil {
+	if err := db.tx.Rollback(); err != nil && err != sql.ErrTxDone {
 		slog.Error("Unable to rollback a transaction", "err", err)
 		return false
 	}
 	return true
 }
 
+// execContext is the context of the transaction, if any
+func (db *DB) execContext() context.Context {
+	if db.ctx != nil {
+		return db.ctx
+	}
+	return context.Background()
+}
+
+func (db *DB) Exec(query string, args ...any) (sql.Result, error) {
+	if db.tx != nil {
+		return db.tx.ExecContext(db.ctx, query, args...)
+	}
+	return db.DB.ExecContext(db.execContext(), query, args...)
+}
+
+func (db *DB) Prepare(query string) (*sql.Stmt, error) {
+	if db.tx != nil {
+		return db.tx.PrepareContext(db.ctx, query)
+	}
+	return db.DB.Prepare(query)
+}
+
+func (db *DB) Query(query string, args ...any) (*sql.Rows, error) {
+	if db.tx != nil {
+		return db.tx.QueryContext(db.ctx, query, args...)
+	}
+	return db.DB.Query(query, args...)
+}
+
 func (db *DB) CreateIndexes(indexes []Index) bool {
 	ret := true
 	cmdTemplate := "CREATE %s INDEX IF NOT EXISTS %s ON %s (%s)"
@@ -495,22 +1041,3 @@ func (db *DB) CreateIndexes(indexes []Index) bool {
 
 	return ret
 }
-
-func mapNames(aggr []string, col []string, format string) string {
-	cola := []string{}
-	for i, f := range aggr {
-		if f == "sum" || f == "min" || f == "max" || f == "avg" {
-			var subformat string
-			if len(col) > 0 {
-				subformat = fmt.Sprintf(format, col[i])
-			} else {
-				subformat = format
-			}
-			c := fmt.Sprintf(subformat, f)
-			cola = append(cola, c)
-		}
-
-	}
-	cols := strings.Join(cola, ", ")
-	return cols
-}
@@ -0,0 +1,220 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package handlers
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsolidateItemTimeout(t *testing.T) {
+	defer SetConsolidationTimeout(0)
+	measReceived = make(map[string]int64)
+
+	item := Item{src: "measurements_t", src_delete: "yes", dst: "t_hourly", alist: "AVG(value)", clist: "vavg", period: 3600, bucket: secondsBucketer{3600}}
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// the work of the shutdown is aborted after drain, if any
+		drain time.Duration
+		reply fakeReply
+		want  bool
+	}{
+		{"committed", time.Second, 0, fakeReply{}, true},
+		{"failed", time.Second, 0, fakeReply{err: errors.New("lost")}, false},
+		{"timed out", 50 * time.Millisecond, 0, fakeReply{block: true}, false},
+		{"drain timed out", 0, 50 * time.Millisecond, fakeReply{block: true}, false},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		f.on(`^INSERT INTO t_hourly`, tt.reply)
+		SetConsolidationTimeout(tt.timeout)
+		work, abort := context.WithCancel(context.Background())
+		if tt.drain > 0 {
+			time.AfterFunc(tt.drain, abort)
+		}
+		got := db.ConsolidateItem(work, item, 0, 7200)
+		abort()
+		if got != tt.want {
+			t.Errorf("%s: ConsolidateItem = %v, want %v", tt.name, got, tt.want)
+		}
+		if committed := len(f.executed(`^COMMIT$`)) > 0; committed != tt.want {
+			t.Errorf("%s: committed %v, want %v", tt.name, committed, tt.want)
+		}
+		// the source rows are deleted within the transaction only
+		if deleted := len(f.executed(`^DELETE FROM measurements_t\b`)) > 0; deleted != tt.want {
+			t.Errorf("%s: source deleted %v, want %v", tt.name, deleted, tt.want)
+		}
+	}
+}
+
+func TestConsolidatorStops(t *testing.T) {
+	f, db := newFakeDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.consolidator(ctx, context.Background(), time.Hour)
+	}()
+
+	// the first pass reads the dispatching table at once
+	deadline := time.Now().Add(time.Second)
+	for len(f.executed(`FROM dispatch\b`)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if len(f.executed(`FROM dispatch\b`)) == 0 {
+		t.Error("dispatching table not read")
+	}
+	SetConsolidationInterval(time.Minute)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("consolidator still running")
+	}
+	// the interval not taken by the consolidator is left for the next one
+	select {
+	case <-reinterval:
+	default:
+	}
+}
+
+func TestMigrateDispatchingTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		legacy  int64
+		insert  error
+		want    bool
+		migrate bool
+	}{
+		{"new table", 0, nil, true, false},
+		{"legacy columns", 4, nil, true, true},
+		{"copy failed", 4, errors.New("lost"), false, true},
+	}
+	for _, tt := range tests {
+		f, db := newFakeDB(t)
+		f.on(`information_schema\.columns`, fakeReply{cols: []string{"n"}, rows: [][]driver.Value{{tt.legacy}}})
+		f.on(`^INSERT INTO dispatch_aggregates`, fakeReply{err: tt.insert})
+		if got := db.MigrateDispatchingTable(); got != tt.want {
+			t.Errorf("%s: MigrateDispatchingTable = %v, want %v", tt.name, got, tt.want)
+		}
+		inserts := f.executed(`^INSERT INTO dispatch_aggregates`)
+		if migrate := len(inserts) > 0; migrate != tt.migrate {
+			t.Errorf("%s: aggregates copied %v, want %v", tt.name, migrate, tt.migrate)
+			continue
+		}
+		// the legacy columns get a default once copied only
+		if modified := len(f.executed(`MODIFY aggr1`)) > 0; modified != (tt.migrate && tt.want) {
+			t.Errorf("%s: legacy columns modified %v", tt.name, modified)
+		}
+		if !tt.migrate {
+			continue
+		}
+		// one statement copies the 4 ranks of the items not migrated yet
+		selects := strings.Split(inserts[0].query, " UNION ALL ")
+		if len(inserts) != 1 || len(selects) != 4 {
+			t.Fatalf("%s: %d statements of %d selects, want 1 of 4", tt.name, len(inserts), len(selects))
+		}
+		for i, sel := range selects {
+			n := string(rune('1' + i))
+			for _, part := range []string{
+				"d.aggr" + n + ", IF(s.dst_table IS NULL, 'value', CONCAT('v', s.aggr" + n + ")), CONCAT('v', d.aggr" + n + ")",
+				"WHERE d.aggr" + n + " <> '' AND d.dst_table NOT IN (SELECT dst_table FROM dispatch_aggregates)",
+			} {
+				if !strings.Contains(sel, part) {
+					t.Errorf("%s: rank %s copied by %q, want %q in it", tt.name, n, sel, part)
+				}
+			}
+		}
+	}
+}
+
+func TestMigratedAggregates(t *testing.T) {
+	// the rows copied from aggr1 = AVG and aggr2 = max of a raw item and
+	// of an item consolidating it
+	f, db := newFakeDB(t)
+	f.on(`FROM dispatch_aggregates`, fakeReply{
+		cols: []string{"dst_table", "func", "field", "name"},
+		rows: [][]driver.Value{
+			{"t_daily", "AVG", "vavg", "vavg"},
+			{"t_daily", "max", "vmax", "vmax"},
+			{"t_hourly", "AVG", "value", "vavg"},
+			{"t_hourly", "max", "value", "vmax"},
+		},
+	})
+	aggr, err := db.ReadAggregatesTable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hourly := Item{src: "measurements_t", dst: "t_hourly", period: 3600, aggr: aggr["t_hourly"]}
+	daily := Item{src: "t_hourly", dst: "t_daily", period: 86400, aggr: aggr["t_daily"]}
+	if err := hourly.prepare(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := daily.prepare(&hourly); err != nil {
+		t.Fatal(err)
+	}
+
+	// the columns are the ones of the legacy layout
+	tests := []struct {
+		item  Item
+		names []string
+		cols  []string
+	}{
+		{hourly, []string{"vavg", "vmax"}, []string{"value", "value"}},
+		{daily, []string{"vavg", "vmax"}, []string{"vavg", "vmax"}},
+	}
+	for _, tt := range tests {
+		if !slices.Equal(tt.item.names, tt.names) || !slices.Equal(tt.item.cols, tt.cols) {
+			t.Errorf("%s: columns %v from %v, want %v from %v", tt.item.dst, tt.item.names, tt.item.cols, tt.names, tt.cols)
+		}
+	}
+}
+
+func TestSetConsolidationInterval(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		err      bool
+	}{
+		{time.Minute, false},
+		{0, true},
+		{-time.Minute, true},
+	}
+	for _, tt := range tests {
+		err := SetConsolidationInterval(tt.interval)
+		if (err != nil) != tt.err {
+			t.Errorf("SetConsolidationInterval(%s) error %v, want error %v", tt.interval, err, tt.err)
+		}
+		// the running consolidator gets the valid intervals only
+		select {
+		case d := <-reinterval:
+			if tt.err || d != tt.interval {
+				t.Errorf("SetConsolidationInterval(%s): %s sent", tt.interval, d)
+			}
+		default:
+			if !tt.err {
+				t.Errorf("SetConsolidationInterval(%s): nothing sent", tt.interval)
+			}
+		}
+	}
+}
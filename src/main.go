@@ -18,67 +18,245 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"menie.org/mqtt2sql/handlers"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	brokerURL string
 	subtopic  string
 	infile    string
+	informat  string
+	csvcols   string
+	csvmeas   string
+	mapfile   string
+	rulesfile string
+	rulesmode bool
+	replay    string
+	speed     float64
+	capture   string
+	rotate    time.Duration
+	capsize   int64
+	capkeep   int
+	qsizes    string
+	overflow  string
+	spilldir  string
+	shutdown  time.Duration
+	interval  time.Duration
+	grace     time.Duration
+	itemtime  time.Duration
+	lateness  time.Duration
+	delchunk  string
+	delpause  time.Duration
+	deldefer  bool
+	partunit  string
+	partahead int
+	sensreg   bool
+	cfgfile   string
+	httpaddr  string
+	loglevel  string
+	readyage  time.Duration
+	testmap   bool
 	debugmode bool
+	logLevel  = &slog.LevelVar{} // INFO par défaut
 )
 
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "recompute":
+			os.Exit(recompute(os.Args[2:]))
+		case "rules":
+			os.Exit(rules(os.Args[2:]))
+		}
+	}
+
 	setFlags()
 	setLogger()
 
-	if subtopic == "" && infile == "" {
+	if cfgfile != "" {
+		if err := loadConfig(cfgfile); err != nil {
+			slog.Error("Config", "error", err)
+			os.Exit(2)
+		}
+	}
+	if err := checkOptions(); err != nil {
+		slog.Error("Config", "error", err)
+		os.Exit(2)
+	}
+	if err := errors.Join(setLogLevel(), setOptions()); err != nil {
+		slog.Error("Config", "error", err)
+		os.Exit(2)
+	}
+	applied = optionValues()
+	handlers.SetSensorRegistry(sensreg)
+
+	if err := handlers.ConfigureQueues(qsizes, overflow, spilldir); err != nil {
+		slog.Error("Queues", "error", err)
+		os.Exit(2)
+	}
+
+	if testmap {
+		if mapfile == "" {
+			slog.Error("Mapping file not specified, use '-m file'")
+			os.Exit(2)
+		}
+		if !handlers.TestMapping(mapfile) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if mapfile != "" {
+		if err := handlers.LoadMapping(mapfile); err != nil {
+			slog.Error("Mapping", "filename", mapfile, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if rulesfile != "" && !handlers.ReconcileRules(rulesfile, rulesmode) {
+		os.Exit(1)
+	}
+
+	if subtopic == "" && infile == "" && replay == "" {
 		slog.Error("Topic not specified, use '-s topic'")
-		return
+		os.Exit(2)
+	}
+
+	ctx, stop := shutdownContext()
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
+	if httpaddr != "" {
+		handlers.HTTPHandler(ctx, httpaddr, reload, readyage)
 	}
 
 	if infile != "" {
-		ch1 := handlers.FileHandler(infile)
+		ff := handlers.FileFormat{Format: informat, Columns: strings.Split(csvcols, ","), Measurement: csvmeas}
+		if err := ff.Check(infile); err != nil {
+			slog.Error("Config", "error", err, "hint", "use -csv-columns with a measurement column or -csv-measurement")
+			os.Exit(2)
+		}
+		ch1 := handlers.FileHandler(ctx, infile, ff)
 		ch2 := handlers.JSONHandler(ch1)
 		handlers.SqlBatchHandler(ch2)
 		os.Exit(0)
 	}
 
-	if ch1 := handlers.MQTTHandler(brokerURL, subtopic); ch1 != nil {
-		ch2 := handlers.JSONHandler(ch1)
-		handlers.SqlHandler(ch2)
+	var ch1 chan handlers.Message
+	if replay != "" {
+		ch1 = handlers.FileHandler(ctx, replay, handlers.FileFormat{Format: "capture", Speed: speed})
+	} else if ch1 = handlers.MQTTHandler(ctx, brokerURL, subtopic); ch1 == nil {
+		os.Exit(1)
+	} else if capture != "" {
+		opts := handlers.CaptureOptions{Rotate: rotate, MaxSize: capsize * 1024 * 1024, Keep: capkeep}
+		ch1 = handlers.CaptureHandler(ch1, capture, opts)
 	}
+	ch2 := handlers.JSONHandler(ch1)
+	if !handlers.SqlHandler(ctx, ch2, interval, shutdown) {
+		os.Exit(1)
+	}
+	slog.Info("Stopped")
+}
+
+// shutdownContext is done on the first SIGINT or SIGTERM, the signals
+// are then no longer caught: a second one kills the process while it
+// drains
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	context.AfterFunc(ctx, func() {
+		slog.Info("Shutting down")
+		stop()
+	})
+	return ctx, stop
 }
 
 func init() {
 	flag.StringVar(&brokerURL, "h", "tcp://mqtt:1883", "MQTT broker to use")
-	flag.StringVar(&subtopic, "s", "", "topic to be subscribed")
-	flag.StringVar(&infile, "r", "", "input file, replacing mqtt input")
+	flag.StringVar(&subtopic, "s", "", "topics to be subscribed, comma separated (spBv1.0/# for Sparkplug B)")
+	flag.StringVar(&infile, "r", "", "input file, directory or glob pattern, files read in name order, replacing mqtt input (gzip or zstd compressed or not)")
+	flag.StringVar(&informat, "format", "", "input file format: json, ndjson or csv (guessed from the file name by default)")
+	flag.StringVar(&csvcols, "csv-columns", "timestamp,id,value", "csv columns among timestamp, id, value, measurement, name and place, empty to skip")
+	flag.StringVar(&csvmeas, "csv-measurement", "", "measurement of the csv rows without measurement column")
+	flag.StringVar(&replay, "replay", "", "capture file, directory or glob pattern replayed into the database in name order, replacing mqtt input")
+	flag.Float64Var(&speed, "replay-speed", 0, "replay speed, 1 for the original pace, 0 for as fast as possible")
+	flag.StringVar(&capture, "capture", "", "directory where the received mqtt messages are captured")
+	flag.DurationVar(&rotate, "capture-rotate", time.Hour, "age of a capture file before rotation")
+	flag.Int64Var(&capsize, "capture-size", 100, "size in MB of a capture file before rotation")
+	flag.IntVar(&capkeep, "capture-keep", 0, "number of capture files kept, 0 to keep them all")
+	flag.StringVar(&qsizes, "queue-size", "10", "capacity of the queues between stages, default and per stage (mqtt, capture, file, json): 100,mqtt=1000")
+	flag.StringVar(&overflow, "overflow", "block", "policy of a full queue, block, drop-oldest, drop-newest or spill, default and per stage: block,mqtt=spill")
+	flag.StringVar(&spilldir, "spill-dir", "", "directory of the spill files (system temporary directory by default)")
+	flag.StringVar(&mapfile, "m", "", "JSON mapping rules file")
+	flag.StringVar(&rulesfile, "rules", "", "YAML consolidation rules file reconciled with the dispatching table at startup and on reload")
+	flag.BoolVar(&rulesmode, "rules-apply", false, "update the dispatching rules differing from the rules file instead of only reporting them")
+	flag.BoolVar(&testmap, "test-mapping", false, "run the tests of the mapping rules file and exit")
+	flag.DurationVar(&shutdown, "shutdown-timeout", 20*time.Second, "time allowed to drain the pipeline on SIGTERM or SIGINT")
+	flag.DurationVar(&interval, "interval", 3*time.Minute, "interval between reads of the dispatching table")
+	flag.DurationVar(&grace, "grace", 40*time.Second, "delay between the end of a period and its consolidation")
+	flag.DurationVar(&itemtime, "consolidation-timeout", 0, "maximum duration of the consolidation of a dispatching item, 0 for none")
+	flag.DurationVar(&lateness, "late-tolerance", 24*time.Hour, "maximum age of a late datapoint consolidated again, older ones are only inserted, 0 to only count them")
+	flag.StringVar(&delchunk, "delete-chunk", "10000", "rows, or duration of data, deleted per statement by the retention and the source cleanup, out of the consolidation transaction, 0 for single statements")
+	flag.DurationVar(&delpause, "delete-pause", 0, "pause between two delete chunks")
+	flag.BoolVar(&deldefer, "delete-after-commit", false, "delete the source data and apply the retention once the consolidation committed, out of its transaction; the late data is then not merged into the rules deleting their source")
+	flag.StringVar(&partunit, "partition", "", "partition the new tables by day or month of ts (MariaDB), expired partitions being dropped as retention")
+	flag.IntVar(&partahead, "partition-ahead", 3, "partitions created ahead of the current one")
+	flag.BoolVar(&sensreg, "sensor-registry", false, "refer to the sensors by a key of the sensors table in the measurement and consolidated tables, refused when tables of the other layout exist")
+	flag.StringVar(&cfgfile, "c", "", "JSON configuration file, keys are option names, reloaded on SIGHUP")
+	flag.StringVar(&httpaddr, "http", "", "listen address of the HTTP endpoints, e.g. :8081 (POST /admin/reload, GET /metrics, /healthz, /readyz)")
+	flag.DurationVar(&readyage, "ready-max-age", 10*time.Minute, "maximum age of the last insert and consolidation for /readyz")
+	flag.StringVar(&loglevel, "log-level", "info", "log level: debug, info, warn or error")
 	flag.BoolVar(&debugmode, "debug", false, "set loglevel to DEBUG")
 }
 
 func setFlags() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s recompute -rule table -from time -to time [-dry-run] [-force]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s rules list|add|remove|validate|export|import [options]\n", os.Args[0])
 		fmt.Fprintf(flag.CommandLine.Output(), "Options:\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) { cmdline[f.Name] = true })
 }
 
 func setLogger() {
-	logLevel := &slog.LevelVar{} // INFO par défaut
-	if debugmode {
-		logLevel.Set(slog.LevelDebug)
-	}
 	opts := &slog.HandlerOptions{
 		Level: logLevel,
 	}
 	logger := slog.New(slog.NewJSONHandler(os.Stderr, opts))
 	slog.SetDefault(logger)
 }
+
+// setLogLevel applies -log-level, or -debug which takes precedence
+func setLogLevel() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(loglevel)); err != nil {
+		return err
+	}
+	if debugmode {
+		level = slog.LevelDebug
+	}
+	if level != logLevel.Level() {
+		logLevel.Set(level)
+		slog.Info("Log level", "level", level)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"menie.org/mqtt2sql/handlers"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// recompute runs the recompute subcommand:
+//
+//	mqtt2sql recompute -rule cons_hour -from 2025-03-01 -to 2025-03-08 -dry-run
+func recompute(args []string) int {
+	var opts handlers.RecomputeOptions
+	fs := flag.NewFlagSet("recompute", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s recompute -rule table -from time -to time [-dry-run] [-force]\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "Deletes and consolidates again the buckets of a rule and of the rules depending on it.\n")
+		fmt.Fprintf(fs.Output(), "Options:\n")
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.Rule, "rule", "", "destination table of the dispatching rule")
+	fs.StringVar(&opts.From, "from", "", "start of the range: date (2006-01-02), local time (2006-01-02 15:04:05), RFC 3339 time or epoch")
+	fs.StringVar(&opts.To, "to", "", "end of the range, excluded")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "print the affected row counts only")
+	fs.BoolVar(&opts.Force, "force", false, "recompute even when the source data is missing or deleted by the consolidation")
+	fs.BoolVar(&sensreg, "sensor-registry", false, "the tables refer to the sensors by a key of the sensors table")
+	fs.StringVar(&loglevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.Parse(args)
+	handlers.SetSensorRegistry(sensreg)
+
+	setLogger()
+	if err := setLogLevel(); err != nil {
+		slog.Error("Config", "error", err)
+		return 2
+	}
+	if opts.Rule == "" || opts.From == "" || opts.To == "" {
+		fs.Usage()
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if !handlers.Recompute(ctx, opts) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+/*
+  This program is free software: you can redistribute it and/or modify
+  it under the terms of the GNU General Public License as published by
+  the Free Software Foundation, either version 3 of the License, or
+  (at your option) any later version.
+
+  This program is distributed in the hope that it will be useful,
+  but WITHOUT ANY WARRANTY; without even the implied warranty of
+  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+  GNU General Public License for more details.
+
+  You should have received a copy of the GNU General Public License
+  along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+  Copyright © 2025 Georges Ménie.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"menie.org/mqtt2sql/handlers"
+	"os"
+)
+
+// rules runs the rules subcommand, which manages the dispatching table:
+//
+//	mqtt2sql rules add -rank 3 -src measurements_power -dst power_1h -period 3600 -aggr "avg, integralh as energy"
+//	mqtt2sql rules export > rules.yaml
+func rules(args []string) int {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s rules list|add|remove|validate|export|import [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Use '%s rules <action> -h' for the options of an action.\n", os.Args[0])
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	var (
+		rule     handlers.Rule
+		aggr     string
+		filter   string
+		filename string
+		output   string
+		dryRun   bool
+	)
+	fs := flag.NewFlagSet("rules "+args[0], flag.ExitOnError)
+	fs.StringVar(&loglevel, "log-level", "info", "log level: debug, info, warn or error")
+	switch args[0] {
+	case "list", "export":
+		fs.StringVar(&output, "o", "", "output file, default stdout")
+	case "add":
+		fs.Int64Var(&rule.Rank, "rank", 0, "rank of the rule")
+		fs.StringVar(&rule.Source, "src", "", "source table")
+		fs.StringVar(&rule.Dest, "dst", "", "destination table")
+		fs.Int64Var(&rule.Period, "period", 0, "period, in seconds or in calendar units")
+		fs.BoolVar(&rule.Disabled, "disabled", false, "add the rule disabled, without period")
+		fs.StringVar(&rule.Unit, "unit", "", "calendar unit of the period: day, week or month")
+		fs.StringVar(&rule.Timezone, "timezone", "", "time zone of the calendar unit, default local")
+		fs.Int64Var(&rule.Retention, "retention", 0, "retention of the destination data, in hours, 0 for ever")
+		fs.StringVar(&rule.Schedule, "schedule", "", "cron expression, default end of the period")
+		fs.BoolVar(&rule.SrcDelete, "src-delete", false, "delete the source data once consolidated")
+		fs.StringVar(&aggr, "aggr", "", "aggregates: func, func(field) or func(field) as column, comma separated")
+		fs.StringVar(&filter, "filter", "", `sensors filter in JSON: {"sensors": [...], "names": [...], "places": [...], "tags": [{"tag": "place", "op": "!=", "value": "garage"}]}`)
+	case "remove":
+		fs.StringVar(&rule.Dest, "dst", "", "destination table of the rule")
+	case "validate":
+		fs.StringVar(&filename, "f", "", "YAML file to validate, default the database rules; the source tables are checked in the database")
+	case "import":
+		fs.StringVar(&filename, "f", "", "YAML file of the rules, replacing all the database rules")
+		fs.BoolVar(&dryRun, "dry-run", false, "validate the file only, the regular expressions with the database")
+	default:
+		usage()
+		return 2
+	}
+	fs.Parse(args[1:])
+
+	setLogger()
+	if err := setLogLevel(); err != nil {
+		slog.Error("Config", "error", err)
+		return 2
+	}
+
+	w := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			slog.Error("Rules", "error", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var ok bool
+	switch args[0] {
+	case "list":
+		ok = handlers.RulesList(w)
+	case "export":
+		ok = handlers.RulesExport(w)
+	case "add":
+		if rule.Source == "" || rule.Dest == "" || aggr == "" {
+			fs.Usage()
+			return 2
+		}
+		var err error
+		if rule.Aggregates, err = handlers.ParseAggregates(aggr); err != nil {
+			slog.Error("Rules", "error", err)
+			return 2
+		}
+		if rule.Filter, err = handlers.ParseFilter(filter); err != nil {
+			slog.Error("Rules", "error", err)
+			return 2
+		}
+		ok = handlers.RulesAdd(rule)
+	case "remove":
+		if rule.Dest == "" {
+			fs.Usage()
+			return 2
+		}
+		ok = handlers.RulesRemove(rule.Dest)
+	case "validate":
+		ok = handlers.RulesValidate(filename)
+	case "import":
+		if filename == "" {
+			fs.Usage()
+			return 2
+		}
+		ok = handlers.RulesImport(filename, dryRun)
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}